@@ -1,7 +1,10 @@
 package filecache
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
+	"reflect"
 	"time"
 )
 
@@ -27,3 +30,50 @@ func TimeFromBytes(b []byte) interface{} {
 	}
 	return t
 }
+
+// JsonFromBytes returns a function which decodes json into a new value returned by newT.
+// newT must return a pointer, e.g. func() interface{} { return &MyStruct{} }, which is what
+// the returned function returns. If the json cannot be decoded then nil is returned.
+func JsonFromBytes(newT func() interface{}) func([]byte) interface{} {
+	return func(b []byte) interface{} {
+		if b == nil {
+			return nil
+		}
+
+		v := newT()
+		err := json.Unmarshal(b, v)
+		if err != nil {
+			return nil
+		}
+		return v
+	}
+}
+
+// ToGobBytes encodes a value using encoding/gob
+func ToGobBytes(v interface{}) []byte {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err == nil {
+		return buf.Bytes()
+	}
+	return nil
+}
+
+// GobFromBytes returns a function which decodes gob encoded values of the same type as prototype.
+// The caller supplies the concrete type, e.g. GobFromBytes(MyStruct{}), and the returned values
+// will be of that type, not a pointer to it.
+func GobFromBytes(prototype interface{}) func([]byte) interface{} {
+	t := reflect.TypeOf(prototype)
+	return func(b []byte) interface{} {
+		if b == nil {
+			return nil
+		}
+
+		v := reflect.New(t)
+		err := gob.NewDecoder(bytes.NewReader(b)).DecodeValue(v)
+		if err != nil {
+			return nil
+		}
+		return v.Elem().Interface()
+	}
+}
@@ -0,0 +1,91 @@
+package filecache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type gobRecord struct {
+	Name    string
+	Created time.Time
+	Updated time.Time
+}
+
+func TestGobBytes(t *testing.T) {
+	now := time.Now()
+	v := gobRecord{Name: "test", Created: now.Add(-time.Hour), Updated: now}
+
+	got, ok := GobFromBytes(gobRecord{})(ToGobBytes(v)).(gobRecord)
+	if !ok {
+		t.Fatal("GobFromBytes did not return a gobRecord")
+	}
+	if got.Name != v.Name || !got.Created.Equal(v.Created) || !got.Updated.Equal(v.Updated) {
+		t.Errorf("got %+v, expected %+v", got, v)
+	}
+
+	if v := GobFromBytes(gobRecord{})([]byte("not gob")); v != nil {
+		t.Errorf("invalid gob decoded to %v", v)
+	}
+}
+
+func TestGobBytes_table(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		ToBytes:        ToGobBytes,
+		FromBytes:      GobFromBytes(gobRecord{}),
+	})
+
+	v := gobRecord{Name: "test", Created: time.Now()}
+	table.Add("k", v)
+	table.FlushMemory()
+
+	got, ok := mustGet(t, table, "k").(gobRecord)
+	if !ok || got.Name != v.Name || !got.Created.Equal(v.Created) {
+		t.Errorf("got %+v, expected %+v", got, v)
+	}
+}
+
+func TestJsonFromBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		newT     func() interface{}
+		json     string
+		expected interface{}
+	}{
+		{
+			name:     "struct",
+			newT:     func() interface{} { return &gobRecord{} },
+			json:     `{"Name":"test"}`,
+			expected: &gobRecord{Name: "test"},
+		},
+		{
+			name:     "slice",
+			newT:     func() interface{} { return &[]int{} },
+			json:     `[1,2,3]`,
+			expected: &[]int{1, 2, 3},
+		},
+		{
+			name:     "map",
+			newT:     func() interface{} { return &map[string]int{} },
+			json:     `{"a":1,"b":2}`,
+			expected: &map[string]int{"a": 1, "b": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fromBytes := JsonFromBytes(tt.newT)
+
+			if got := fromBytes([]byte(tt.json)); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %#v, expected %#v", got, tt.expected)
+			}
+			if got := fromBytes([]byte("not json")); got != nil {
+				t.Errorf("invalid json decoded to %#v", got)
+			}
+			if got := fromBytes(nil); got != nil {
+				t.Errorf("nil decoded to %#v", got)
+			}
+		})
+	}
+}
@@ -6,25 +6,65 @@
 package filecache
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 // Cache is an in-memory cache which is also persisted by the underlying filesystem
 type Cache struct {
-	cacheDir string
-	mutex    sync.RWMutex
-	tables   map[string]*CacheTable
-	started  bool
+	cacheDir          string
+	mutex             sync.RWMutex
+	tables            map[string]*CacheTable
+	started           atomic.Bool
+	clock             Clock
+	fs                Filesystem
+	dirMode           os.FileMode
+	logger            Logger
+	maxTotalDiskBytes int64
+	quotaMutex        sync.Mutex
+	tableAdded        TableHook
+	tableRemoved      TableHook
 }
 
 // CacheConfig mutable config for creating the cache
 type CacheConfig struct {
 	// The required path to where all caches will be located on disk
 	CacheDir string
+	// Optional Clock used for all time based behaviour. Defaults to RealClock
+	Clock Clock
+	// Optional Filesystem used to persist the cache. Defaults to OSFilesystem
+	Filesystem Filesystem
+	// Optional permissions for the cache directory. Defaults to DefaultDirMode
+	DirMode os.FileMode
+	// Optional Logger for errors which would otherwise be discarded. Defaults to discarding them
+	Logger Logger
+	// Optional limit on the total size of the disk cache across all tables.
+	// When exceeded the oldest entries of any table are removed from both disk & memory when a table's
+	// disk cache is expired.
+	MaxTotalDiskBytes int64
 }
 
-type CacheDataLoader func(key string, args ...interface{}) *CacheItem
+// CacheDataLoader loads an item not found in either memory or disk.
+// It should return nil, nil if the key does not exist or an error if it could not be loaded.
+type CacheDataLoader func(key string, args ...interface{}) (*CacheItem, error)
+
+// CacheDataLoaderContext is a CacheDataLoader which is passed the context.Context of the Get
+// so it can honor cancellation and deadlines.
+type CacheDataLoaderContext func(ctx context.Context, key string, args ...interface{}) (*CacheItem, error)
+
+// DataLoaderFunc adapts a loader which returns no error to a CacheDataLoader.
+//
+// Deprecated: this is for loaders written before CacheDataLoader returned an error
+func DataLoaderFunc(f func(key string, args ...interface{}) *CacheItem) CacheDataLoader {
+	return func(key string, args ...interface{}) (*CacheItem, error) {
+		return f(key, args...), nil
+	}
+}
 
 type CacheItemCallback func(item *CacheItem)
 
@@ -32,16 +72,64 @@ type CacheKeyCallback func(key string)
 
 type CacheItemWalker func(key string, item *CacheItem)
 
+// CacheItemWalkerE is a CacheItemWalker which can stop the iteration by returning an error
+type CacheItemWalkerE func(key string, item *CacheItem) error
+
+type CacheErrorCallback func(key string, err error)
+
 var (
 	// ErrKeyNotFound gets returned when a specific key couldn't be found
 	ErrKeyNotFound = errors.New("keynotfound")
+	// ErrNilData gets returned when data is nil
+	ErrNilData = errors.New("nildata")
+	// ErrEncode gets reported when a value cannot be encoded by the table's ToBytes function
+	ErrEncode = errors.New("encodefailed")
+	// ErrCorrupt gets reported when an entry on disk fails its checksum or has been truncated
+	ErrCorrupt = errors.New("corrupt")
+	// ErrInvalidKey gets returned when a key cannot be used, see CacheItem.IsValid
+	ErrInvalidKey = errors.New("invalidkey")
+	// ErrInvalidLifespan gets returned when a lifeSpan is negative
+	ErrInvalidLifespan = errors.New("invalidlifespan")
+	// ErrKeyExists gets returned when a key already exists
+	ErrKeyExists = errors.New("keyexists")
+	// ErrStopIteration can be returned by a CacheItemWalkerE to stop iterating without ForeachE returning an error
+	ErrStopIteration = errors.New("stopiteration")
+	// ErrNotStarted gets returned when an operation requires the table to have been started
+	ErrNotStarted = errors.New("notstarted")
+	// ErrPanic gets reported when a ToBytes or FromBytes function panics
+	ErrPanic = errors.New("panic")
 )
 
 // NewCache creates a new Cache based on the supplied config
 func NewCache(cfg CacheConfig) *Cache {
+	clock := cfg.Clock
+	if clock == nil {
+		clock = RealClock
+	}
+
+	fs := cfg.Filesystem
+	if fs == nil {
+		fs = OSFilesystem{}
+	}
+
+	dirMode := cfg.DirMode
+	if dirMode == 0 {
+		dirMode = DefaultDirMode
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = noopLogger{}
+	}
+
 	f := &Cache{
-		cacheDir: cfg.CacheDir,
-		tables:   map[string]*CacheTable{},
+		cacheDir:          cfg.CacheDir,
+		tables:            map[string]*CacheTable{},
+		clock:             clock,
+		fs:                fs,
+		dirMode:           dirMode,
+		logger:            logger,
+		maxTotalDiskBytes: cfg.MaxTotalDiskBytes,
 	}
 
 	return f
@@ -52,7 +140,7 @@ func (c *Cache) Start() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if c.started {
+	if c.started.Load() {
 		return errors.New("cache already started")
 	}
 
@@ -61,15 +149,18 @@ func (c *Cache) Start() error {
 		return err
 	}
 
-	// Start all tables
+	// Start all tables, stopping those already started if one fails so we remain stopped
 	for _, t := range c.tables {
 		err = t.start()
 		if err != nil {
+			for _, t := range c.tables {
+				t.stop()
+			}
 			return err
 		}
 	}
 
-	c.started = true
+	c.started.Store(true)
 
 	return nil
 }
@@ -79,7 +170,7 @@ func (c *Cache) Stop() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if !c.started {
+	if !c.started.Load() {
 		return
 	}
 
@@ -87,7 +178,12 @@ func (c *Cache) Stop() {
 		t.stop()
 	}
 
-	c.started = false
+	c.started.Store(false)
+}
+
+// Started returns true if the cache has been started
+func (c *Cache) Started() bool {
+	return c.started.Load()
 }
 
 // GetCache returns the named CacheTable or nil if it doesn't exist
@@ -96,3 +192,75 @@ func (c *Cache) GetCache(n string) *CacheTable {
 	defer c.mutex.RUnlock()
 	return c.tables[n]
 }
+
+// RemoveCache stops & removes the named CacheTable from the cache.
+// If deleteDisk is true then the table's directory is also deleted once any queued entries have been persisted.
+// Returns an error if the table does not exist.
+func (c *Cache) RemoveCache(name string, deleteDisk bool) error {
+	c.mutex.Lock()
+	t, exists := c.tables[name]
+	if !exists {
+		c.mutex.Unlock()
+		return fmt.Errorf("cache %s does not exist", name)
+	}
+
+	t.stop()
+	t.mutex.Lock()
+	t.stopMemoryExpiryTimer()
+	t.mutex.Unlock()
+	delete(c.tables, name)
+
+	var err error
+	if deleteDisk {
+		err = c.fs.RemoveAll(t.basePath)
+	}
+	removed := c.tableRemoved
+	c.mutex.Unlock()
+
+	// Outside the lock so the hook can use the cache
+	removed.call(t)
+	return err
+}
+
+// ListCaches returns the sorted names of all CacheTable's registered with this cache
+func (c *Cache) ListCaches() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	names := make([]string, 0, len(c.tables))
+	for name := range c.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tables returns the CacheTable's registered with this cache
+func (c *Cache) Tables() []*CacheTable {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	tables := make([]*CacheTable, 0, len(c.tables))
+	for _, t := range c.tables {
+		tables = append(tables, t)
+	}
+	return tables
+}
+
+// FlushAll removes all entries from memory & disk for every table in this cache
+func (c *Cache) FlushAll() {
+	for _, t := range c.Tables() {
+		t.FlushMemoryAndDisk()
+	}
+}
+
+// ExpireAll calls ExpireDisk on every table in this cache, returning the total number of entries expired.
+// MaxTotalDiskBytes is enforced once after every table has been expired.
+func (c *Cache) ExpireAll() int {
+	count := 0
+	for _, t := range c.Tables() {
+		n, _ := t.expireDisk(context.Background(), t.diskExpiryTime)
+		count += n
+	}
+	return count + c.enforceTotalDiskQuota()
+}
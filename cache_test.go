@@ -0,0 +1,335 @@
+package filecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoveCache(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, PersistQueueSize: 100})
+	cache := table.parent
+
+	for i := 0; i < 50; i++ {
+		table.Add(fmt.Sprintf("k%d", i), "v")
+	}
+
+	if err := cache.RemoveCache("test", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(table.basePath); !os.IsNotExist(err) {
+		t.Errorf("table directory still exists: %v", err)
+	}
+	if cache.GetCache("test") != nil {
+		t.Error("GetCache returned the removed table")
+	}
+
+	if err := cache.RemoveCache("test", true); err == nil {
+		t.Error("removing a missing table did not fail")
+	}
+}
+
+func TestRemoveCache_keepsOtherTables(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{Name: "a", StartupOptions: noStartup, SyncPersist: true},
+		CacheTableConfig{Name: "b", StartupOptions: noStartup, SyncPersist: true},
+	)
+	a, b := tables[0], tables[1]
+	b.Add("k", "v")
+
+	if err := a.parent.RemoveCache("a", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(a.basePath); !os.IsNotExist(err) {
+		t.Errorf("table directory still exists: %v", err)
+	}
+	if v := mustGet(t, b, "k"); v != "v" {
+		t.Errorf("got %v from the remaining table", v)
+	}
+}
+
+func TestAddCache_invalidName(t *testing.T) {
+	cache := NewCache(CacheConfig{CacheDir: t.TempDir()})
+	for _, name := range []string{"", ".", "..", "../other", "a/b"} {
+		if _, err := cache.AddCache(CacheTableConfig{Name: name}); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("AddCache(%q) returned %v, expected ErrInvalidKey", name, err)
+		}
+		if _, err := cache.GetOrCreateCache(CacheTableConfig{Name: name}); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("GetOrCreateCache(%q) returned %v, expected ErrInvalidKey", name, err)
+		}
+	}
+	if names := cache.ListCaches(); len(names) != 0 {
+		t.Errorf("tables added %v", names)
+	}
+}
+
+func TestListCaches(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{Name: "c", StartupOptions: noStartup},
+		CacheTableConfig{Name: "a", StartupOptions: noStartup},
+		CacheTableConfig{Name: "b", StartupOptions: noStartup},
+	)
+
+	names := tables[0].parent.ListCaches()
+	if strings.Join(names, ",") != "a,b,c" {
+		t.Errorf("ListCaches returned %v", names)
+	}
+}
+
+func TestGetOrCreateCache_concurrent(t *testing.T) {
+	cache := NewCache(CacheConfig{CacheDir: t.TempDir()})
+	var created atomic.Int32
+	cache.SetTableLifecycleHooks(func(*CacheTable) {
+		created.Add(1)
+	}, nil)
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cache.Stop)
+
+	const n = 50
+	tables := make([]*CacheTable, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			table, err := cache.GetOrCreateCache(CacheTableConfig{Name: "test", StartupOptions: noStartup})
+			if err != nil {
+				t.Error(err)
+			}
+			tables[i] = table
+		}(i)
+	}
+	wg.Wait()
+
+	if c := created.Load(); c != 1 {
+		t.Errorf("%d tables created, expected 1", c)
+	}
+	for i, table := range tables {
+		if table != tables[0] {
+			t.Errorf("call %d returned a different table", i)
+		}
+	}
+}
+
+func TestStartStop_underLoad(t *testing.T) {
+	cache := NewCache(CacheConfig{CacheDir: t.TempDir()})
+	table, err := cache.AddCache(CacheTableConfig{
+		Name:             "test",
+		StartupOptions:   noStartup,
+		PersistQueueSize: 10,
+		ToBytes:          stringToBytes,
+		FromBytes:        stringFromBytes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("k%d-%d", w, i%20)
+				table.Add(key, "v")
+				_, _ = table.Get(key)
+			}
+		}(w)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := cache.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		cache.Stop()
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestFlushAll(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{Name: "a", StartupOptions: noStartup, SyncPersist: true},
+		CacheTableConfig{Name: "b", StartupOptions: noStartup, SyncPersist: true},
+	)
+	for _, table := range tables {
+		table.Add("k1", "v")
+		table.Add("k2", "v")
+	}
+
+	tables[0].parent.FlushAll()
+
+	for _, table := range tables {
+		if n := table.Count(); n != 0 {
+			t.Errorf("%s: Count %d", table.Name(), n)
+		}
+		if n := table.DiskCount(); n != 0 {
+			t.Errorf("%s: DiskCount %d", table.Name(), n)
+		}
+	}
+}
+
+func TestExpireAll(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{Name: "a", StartupOptions: noStartup, SyncPersist: true, DiskExpiryTime: time.Hour},
+		CacheTableConfig{Name: "b", StartupOptions: noStartup, SyncPersist: true, DiskExpiryTime: time.Hour},
+	)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, table := range tables {
+		table.Add("old", "v")
+		table.Add("new", "v")
+		table.FlushMemory()
+		setModTime(t, table, "old", old)
+	}
+
+	if n := tables[0].parent.ExpireAll(); n != 2 {
+		t.Errorf("ExpireAll expired %d, expected 2", n)
+	}
+	for _, table := range tables {
+		if table.Exists("old") || !table.Exists("new") {
+			t.Errorf("%s: wrong entries expired", table.Name())
+		}
+	}
+}
+
+func TestStarted(t *testing.T) {
+	cache := NewCache(CacheConfig{CacheDir: t.TempDir()})
+	before, err := cache.AddCache(CacheTableConfig{Name: "before", StartupOptions: noStartup})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping before starting does nothing
+	cache.Stop()
+	if cache.Started() || before.Started() {
+		t.Fatal("started before Start")
+	}
+
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !cache.Started() || !before.Started() {
+		t.Fatal("not started after Start")
+	}
+	if err := cache.Start(); err == nil {
+		t.Error("second Start did not fail")
+	}
+
+	// Tables added once started are started immediately
+	after, err := cache.AddCache(CacheTableConfig{Name: "after", StartupOptions: noStartup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Started() {
+		t.Error("table added after Start not started")
+	}
+
+	cache.Stop()
+	if cache.Started() || before.Started() || after.Started() {
+		t.Error("still started after Stop")
+	}
+	cache.Stop()
+
+	// Restarting starts every table again
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !before.Started() || !after.Started() {
+		t.Error("tables not restarted")
+	}
+	cache.Stop()
+}
+
+func TestStart_tableDirNotWritable(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewCache(CacheConfig{CacheDir: dir})
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Stop()
+
+	// A file where the table's directory should be
+	if err := os.WriteFile(dir+PathSeparator+"file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.AddCache(CacheTableConfig{Name: "file", StartupOptions: noStartup}); err == nil {
+		t.Error("AddCache succeeded when the table directory is a file")
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("read only directories are writable by root")
+	}
+	if err := os.Mkdir(dir+PathSeparator+"readonly", 0555); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.AddCache(CacheTableConfig{Name: "readonly", StartupOptions: noStartup}); err == nil {
+		t.Error("AddCache succeeded when the table directory is read only")
+	}
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	dir := t.TempDir()
+	populate := NewCache(CacheConfig{CacheDir: dir})
+	table, err := populate.AddCache(CacheTableConfig{
+		Name:           "test",
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		ToBytes:        stringToBytes,
+		FromBytes:      stringFromBytes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := populate.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		table.Add(fmt.Sprintf("k%d", i), "v")
+	}
+	populate.Stop()
+
+	cache := NewCache(CacheConfig{CacheDir: dir})
+	table, err = cache.AddCache(CacheTableConfig{
+		Name:           "test",
+		StartupOptions: LoadCacheOnStart,
+		ExpiryTime:     time.Hour,
+		ToBytes:        stringToBytes,
+		FromBytes:      stringFromBytes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WaitUntilReady(context.Background()); err != ErrNotStarted {
+		t.Errorf("WaitUntilReady before Start returned %v, expected %v", err, ErrNotStarted)
+	}
+
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := table.WaitUntilReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := table.Count(); n != 100 {
+		t.Errorf("%d items in memory once ready, expected 100", n)
+	}
+}
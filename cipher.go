@@ -0,0 +1,63 @@
+package filecache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Cipher encrypts entries before they are written to disk & decrypts them when read back
+type Cipher struct {
+	Encrypt func([]byte) ([]byte, error)
+	Decrypt func([]byte) ([]byte, error)
+}
+
+// NewAESGCMCipher returns a Cipher using AES-GCM with the supplied key.
+// The key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+// A random nonce is generated for each entry and stored at the start of the file.
+func NewAESGCMCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{
+		Encrypt: func(b []byte) ([]byte, error) {
+			nonce := make([]byte, gcm.NonceSize())
+			_, err := io.ReadFull(rand.Reader, nonce)
+			if err != nil {
+				return nil, err
+			}
+			return gcm.Seal(nonce, nonce, b, nil), nil
+		},
+		Decrypt: func(b []byte) ([]byte, error) {
+			if len(b) < gcm.NonceSize() {
+				return nil, errors.New("ciphertext too short")
+			}
+			return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+		},
+	}, nil
+}
+
+// encrypt encrypts an entry if the table has a Cipher
+func (table *CacheTable) encrypt(b []byte) ([]byte, error) {
+	if table.cipher == nil {
+		return b, nil
+	}
+	return table.cipher.Encrypt(b)
+}
+
+// decrypt decrypts an entry if the table has a Cipher
+func (table *CacheTable) decrypt(b []byte) ([]byte, error) {
+	if table.cipher == nil {
+		return b, nil
+	}
+	return table.cipher.Decrypt(b)
+}
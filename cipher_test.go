@@ -0,0 +1,67 @@
+package filecache
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func newTestCipher(t *testing.T, fill byte) *Cipher {
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte{fill}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCipher(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, Cipher: newTestCipher(t, 1)})
+
+	const secret = "a secret value"
+	table.Add("k", secret)
+
+	b, err := os.ReadFile(table.getFilePath("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte(secret)) {
+		t.Error("plaintext found on disk")
+	}
+
+	table.FlushMemory()
+	if v := mustGet(t, table, "k"); v != secret {
+		t.Errorf("got %v", v)
+	}
+}
+
+func TestCipher_wrongKeyIsMiss(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, Cipher: newTestCipher(t, 1)})
+
+	table.Add("k", "v")
+	table.FlushMemory()
+
+	table.cipher = newTestCipher(t, 2)
+	if _, err := table.Get("k"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v, expected %v", err, ErrKeyNotFound)
+	}
+	if _, err := table.LastError(); err == nil {
+		t.Error("failed decrypt not recorded")
+	}
+}
+
+func TestNewAESGCMCipher_invalidKey(t *testing.T) {
+	if _, err := NewAESGCMCipher([]byte("short")); err == nil {
+		t.Error("expected error for invalid key length")
+	}
+}
+
+func TestCipher_addStreamRejected(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, Cipher: newTestCipher(t, 1)})
+
+	if err := table.AddStream("k", 0, bytes.NewReader([]byte("a secret value"))); err != ErrEncrypted {
+		t.Errorf("AddStream returned %v, expected %v", err, ErrEncrypted)
+	}
+	if table.existsOnDisk("k") {
+		t.Error("plaintext stream written to disk")
+	}
+}
@@ -0,0 +1,40 @@
+package filecache
+
+import (
+	"time"
+)
+
+// Clock provides the current time. It allows time based behaviour such as expiry to be tested
+// deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the default Clock using the system time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// RealClock is the default Clock which uses the system time
+var RealClock Clock = realClock{}
+
+// now returns the current time from the table's clock
+func (table *CacheTable) now() time.Time {
+	return table.clock.Now()
+}
+
+// newItem creates a new CacheItem using the table's clock
+func (table *CacheTable) newItem(key string, lifeSpan time.Duration, data interface{}) *CacheItem {
+	return table.newCreatedItem(key, lifeSpan, data, table.now())
+}
+
+// newCreatedItem creates a new CacheItem with a specific creation time using the table's clock
+func (table *CacheTable) newCreatedItem(key string, lifeSpan time.Duration, data interface{}, created time.Time) *CacheItem {
+	item := NewCreatedCacheItem(key, lifeSpan, data, created)
+	item.clock = table.clock
+	item.table = table
+	item.accessedOn = table.now()
+	return item
+}
@@ -0,0 +1,37 @@
+package filecache
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a Clock for use in tests whose time only changes when Set or Advance are called
+type FakeClock struct {
+	mutex sync.RWMutex
+	now   time.Time
+}
+
+// NewFakeClock returns a FakeClock set to the supplied time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.now
+}
+
+// Set sets the current time
+func (c *FakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+}
+
+// Advance moves the current time forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,70 @@
+package filecache
+
+import (
+	"time"
+)
+
+// coalesce holds an entry until the debounce period has passed so that if the same key is
+// written again only the latest value is persisted.
+func (table *CacheTable) coalesce(e persistEntry) {
+	table.pendingMutex.Lock()
+	defer table.pendingMutex.Unlock()
+
+	if table.pending == nil {
+		table.pending = make(map[string]persistEntry)
+	}
+	table.pending[e.key] = e
+
+	if table.pendingTimer == nil {
+		table.pendingTimer = time.AfterFunc(table.persistDebounce, table.flushPending)
+	}
+}
+
+// flushPending submits all pending entries to the persistence queue.
+// pendingFlush is held until they have been submitted so stop & Sync wait for a flush already
+// started by the timer rather than returning whilst it is still submitting entries.
+func (table *CacheTable) flushPending() {
+	table.pendingFlush.Lock()
+	defer table.pendingFlush.Unlock()
+
+	table.pendingMutex.Lock()
+	pending := table.pending
+	table.pending = nil
+	if table.pendingTimer != nil {
+		table.pendingTimer.Stop()
+		table.pendingTimer = nil
+	}
+	table.pendingMutex.Unlock()
+
+	for _, e := range pending {
+		table.send(e)
+	}
+}
+
+// pendingEntry returns the entry for key if it is waiting to be coalesced
+func (table *CacheTable) pendingEntry(key string) (persistEntry, bool) {
+	table.pendingMutex.Lock()
+	defer table.pendingMutex.Unlock()
+	e, ok := table.pending[key]
+	return e, ok
+}
+
+// dropPending discards any pending entries whose key matches so a delete is not undone when the
+// pending entries are flushed
+func (table *CacheTable) dropPending(match func(key string) bool) {
+	table.pendingMutex.Lock()
+	defer table.pendingMutex.Unlock()
+
+	for key := range table.pending {
+		if match(key) {
+			delete(table.pending, key)
+		}
+	}
+}
+
+// dropPendingKey discards any pending entry for key
+func (table *CacheTable) dropPendingKey(key string) {
+	table.dropPending(func(k string) bool {
+		return k == key
+	})
+}
@@ -0,0 +1,113 @@
+package filecache
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCoalesce_deleteDropsPending(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, PersistDebounce: time.Hour})
+
+	table.Add("k", "v")
+	table.DeleteFromMemoryAndDisk("k")
+	table.Add("p1", "v")
+	table.Add("p2", "v")
+	table.DeleteByPrefix("p")
+	table.Add("old", "v")
+	if err := table.RenameKey("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	table.Sync()
+
+	for _, key := range []string{"k", "p1", "p2", "old"} {
+		if table.Exists(key) {
+			t.Errorf("%q exists after being deleted", key)
+		}
+	}
+	if !table.Exists("new") {
+		t.Error("renamed key does not exist")
+	}
+}
+
+func TestCoalesce_stopWaitsForFlush(t *testing.T) {
+	cache := NewCache(CacheConfig{CacheDir: t.TempDir()})
+	table, err := cache.AddCache(CacheTableConfig{
+		Name:            "test",
+		StartupOptions:  noStartup,
+		PersistDebounce: time.Millisecond,
+		ToBytes:         stringToBytes,
+		FromBytes:       stringFromBytes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cycle := 0; cycle < 20; cycle++ {
+		if err := cache.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("c%d-%d", cycle, i)
+			keys = append(keys, key)
+			table.Add(key, "v")
+		}
+		time.Sleep(time.Millisecond)
+		cache.Stop()
+
+		for _, key := range keys {
+			if _, err := os.Stat(table.getFilePath(key)); err != nil {
+				t.Fatalf("cycle %d: %v", cycle, err)
+			}
+		}
+	}
+}
+
+func TestCoalesce_rapidUpdates(t *testing.T) {
+	fs := &testFS{}
+	table := newTestTables(t, CacheConfig{Filesystem: fs}, CacheTableConfig{
+		StartupOptions:  noStartup,
+		PersistDebounce: 50 * time.Millisecond,
+	})[0]
+
+	for i := 0; i < 1000; i++ {
+		table.Add("k", fmt.Sprintf("v%d", i))
+	}
+	table.Sync()
+
+	if w := fs.writes.Load(); w > 100 {
+		t.Errorf("%d writes for 1000 updates", w)
+	}
+
+	table.FlushMemory()
+	if v := mustGet(t, table, "k"); v != "v999" {
+		t.Errorf("got %v, expected the last update", v)
+	}
+}
+
+func TestCoalesce_pendingVisibleOnceEvicted(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, PersistDebounce: time.Hour, MaxMemoryItems: 2})
+
+	for i := 0; i < 5; i++ {
+		table.Add(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	table.AddBytes("raw", 0, []byte("bytes"))
+	table.FlushMemory()
+
+	// None of these have been written to disk yet
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if !table.Exists(key) {
+			t.Errorf("%q does not exist", key)
+		}
+		if v := mustGet(t, table, key); v != fmt.Sprintf("v%d", i) {
+			t.Errorf("%q got %v", key, v)
+		}
+	}
+	if b, err := table.GetBytes("raw"); err != nil || string(b) != "bytes" {
+		t.Errorf("GetBytes returned %q %v", b, err)
+	}
+}
@@ -0,0 +1,78 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Codec converts values to & from the []byte slice stored on disk.
+// Codecs are registered with a table via CacheTableConfig.Codecs, allowing a single table to
+// hold values of different types.
+type Codec struct {
+	// Function to convert a value to a []byte slice
+	ToBytes func(interface{}) []byte
+	// Function to unmarshal the value from disk
+	FromBytes func([]byte) interface{}
+}
+
+var (
+	// ErrUnknownCodec is returned when a codec has not been registered with the table
+	ErrUnknownCodec = errors.New("unknowncodec")
+)
+
+// AddWithCodec adds a key/value pair with the specified lifeSpan, encoding the value with the named
+// Codec rather than the table's ToBytes. The codec's name is stored on disk so the value is decoded
+// with the same Codec when it is loaded.
+// This returns the CacheItem just added or nil if there was an error, usually the key is invalid,
+// the lifeSpan is negative, data is nil or the codec has not been registered
+func (table *CacheTable) AddWithCodec(key string, lifeSpan time.Duration, codec string, data interface{}) *CacheItem {
+	if _, _, err := table.codecFuncs(codec); err != nil {
+		return nil
+	}
+
+	item := table.newItem(key, lifeSpan, data)
+	item.codec = codec
+	if !item.IsValid() {
+		return nil
+	}
+
+	table.mutex.Lock()
+	return table.add(item)
+}
+
+// codecFuncs returns the ToBytes & FromBytes functions for the named codec.
+// An empty name returns the table's own functions.
+func (table *CacheTable) codecFuncs(codec string) (func(interface{}) []byte, func([]byte) interface{}, error) {
+	if codec == "" {
+		return table.toBytes, table.fromBytes, nil
+	}
+
+	c, ok := table.codecs[codec]
+	if !ok || c.ToBytes == nil || c.FromBytes == nil {
+		return nil, nil, fmt.Errorf("%q: %w", codec, ErrUnknownCodec)
+	}
+	return c.ToBytes, c.FromBytes, nil
+}
+
+// safeToBytes calls toBytes recovering from any panic so a faulty ToBytes cannot take down the
+// calling goroutine. A panic is returned as an error wrapping both ErrEncode and ErrPanic
+func safeToBytes(toBytes func(interface{}) []byte, v interface{}) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			b, err = nil, fmt.Errorf("%w: %w: %v", ErrEncode, ErrPanic, r)
+		}
+	}()
+	return toBytes(v), nil
+}
+
+// safeFromBytes calls fromBytes recovering from any panic so a faulty FromBytes cannot take down the
+// calling goroutine. A panic is returned as an error wrapping ErrPanic
+func safeFromBytes(fromBytes func([]byte) interface{}, b []byte) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			v, err = nil, fmt.Errorf("%w: %v", ErrPanic, r)
+		}
+	}()
+	return fromBytes(b), nil
+}
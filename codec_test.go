@@ -0,0 +1,135 @@
+package filecache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAddErr_unencodableValue(t *testing.T) {
+	type failure struct {
+		key string
+		err error
+	}
+	failures := make(chan failure, 10)
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		ToBytes:        ToJsonBytes,
+		FromBytes:      stringFromBytes,
+		PersistError: func(key string, err error) {
+			failures <- failure{key, err}
+		},
+	})
+
+	for key, v := range map[string]interface{}{
+		"chan": make(chan int),
+		"func": func() {},
+	} {
+		item, err := table.AddErr(key, v)
+		if !errors.Is(err, ErrEncode) {
+			t.Errorf("%s: AddErr returned %v, expected %v", key, err, ErrEncode)
+		}
+		if item == nil {
+			t.Errorf("%s: item not added to memory", key)
+		}
+
+		select {
+		case f := <-failures:
+			if f.key != key || !errors.Is(f.err, ErrEncode) {
+				t.Errorf("PersistError(%q, %v)", f.key, f.err)
+			}
+		default:
+			t.Errorf("%s: PersistError not called", key)
+		}
+	}
+
+	table.Sync()
+	if n := table.DiskCount(); n != 0 {
+		t.Errorf("DiskCount %d, expected 0", n)
+	}
+}
+
+func TestAddWithCodec(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		Codecs: map[string]Codec{
+			"time": {ToBytes: ToJsonBytes, FromBytes: TimeFromBytes},
+			"gob":  {ToBytes: ToGobBytes, FromBytes: GobFromBytes(gobRecord{})},
+		},
+	})
+
+	now := time.Now()
+	record := gobRecord{Name: "test", Created: now}
+	table.Add("string", "v")
+	if table.AddWithCodec("time", 0, "time", now) == nil {
+		t.Fatal("AddWithCodec time failed")
+	}
+	if table.AddWithCodec("record", 0, "gob", record) == nil {
+		t.Fatal("AddWithCodec gob failed")
+	}
+	if table.AddWithCodec("unknown", 0, "unknown", "v") != nil {
+		t.Error("AddWithCodec succeeded with an unknown codec")
+	}
+
+	table.FlushMemory()
+
+	if v := mustGet(t, table, "string"); v != "v" {
+		t.Errorf("string got %v", v)
+	}
+	if v, ok := mustGet(t, table, "time").(time.Time); !ok || !v.Equal(now) {
+		t.Errorf("time got %v", v)
+	}
+	if v, ok := mustGet(t, table, "record").(gobRecord); !ok || v.Name != record.Name || !v.Created.Equal(now) {
+		t.Errorf("record got %+v", v)
+	}
+}
+
+func TestPanickingCodec(t *testing.T) {
+	failures := make(chan error, 10)
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		ToBytes: func(v interface{}) []byte {
+			if v == "panic" {
+				panic("toBytes failed")
+			}
+			return stringToBytes(v)
+		},
+		FromBytes: func(b []byte) interface{} {
+			if string(b) == "explode" {
+				panic("fromBytes failed")
+			}
+			return stringFromBytes(b)
+		},
+		PersistError: func(key string, err error) {
+			failures <- err
+		},
+	})
+
+	// The panic happens in the persistence goroutine which must survive it
+	table.Add("panic", "panic")
+	table.Sync()
+	select {
+	case err := <-failures:
+		if !errors.Is(err, ErrPanic) {
+			t.Errorf("PersistError %v, expected %v", err, ErrPanic)
+		}
+	default:
+		t.Error("PersistError not called")
+	}
+
+	table.Add("explode", "explode")
+	table.Add("ok", "v")
+	table.Sync()
+	table.FlushMemory()
+
+	if _, err := table.Get("explode"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v, expected %v", err, ErrKeyNotFound)
+	}
+	if _, err := table.LastError(); !errors.Is(err, ErrPanic) {
+		t.Errorf("LastError %v, expected %v", err, ErrPanic)
+	}
+	if v := mustGet(t, table, "ok"); v != "v" {
+		t.Errorf("got %v after a panic, expected v", v)
+	}
+}
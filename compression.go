@@ -0,0 +1,45 @@
+package filecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Compression defines how entries are compressed on disk
+type Compression int
+
+const (
+	// Entries are stored uncompressed
+	NoCompression Compression = iota
+	// Entries are compressed with gzip
+	GzipCompression
+)
+
+// compress compresses an entry with gzip
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses an entry read from disk whose metadata flags it as compressed.
+// The flag is used rather than the table's setting so entries remain readable if compression is
+// changed, including those written before compression was enabled.
+func decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
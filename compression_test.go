@@ -0,0 +1,71 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGzipCompression(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{Name: "plain", StartupOptions: noStartup, SyncPersist: true},
+		CacheTableConfig{Name: "gzip", StartupOptions: noStartup, SyncPersist: true, Compression: GzipCompression},
+	)
+	plain, compressed := tables[0], tables[1]
+
+	payload := strings.Repeat("compressible ", 1000)
+	plain.Add("k", payload)
+	compressed.Add("k", payload)
+
+	plainInfo, err := os.Stat(plain.getFilePath("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedInfo, err := os.Stat(compressed.getFilePath("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressedInfo.Size() >= plainInfo.Size()/10 {
+		t.Errorf("compressed file %d bytes, uncompressed %d bytes", compressedInfo.Size(), plainInfo.Size())
+	}
+
+	compressed.FlushMemory()
+	if v := mustGet(t, compressed, "k"); v != payload {
+		t.Error("compressed value did not round trip")
+	}
+}
+
+func TestGzipCompression_readsLegacyFiles(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, Compression: GzipCompression})
+
+	// A file written before compression, metadata or key headers existed is just the value
+	path := table.getFilePath("legacy")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := mustGet(t, table, "legacy"); v != "old" {
+		t.Errorf("got %v", v)
+	}
+}
+
+func TestNoCompression_valueLikeGzip(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	// Only entries flagged as compressed are decompressed, whatever their content
+	table.Add("k", "FCGZ hello")
+	table.FlushMemory()
+	if v := mustGet(t, table, "k"); v != "FCGZ hello" {
+		t.Errorf("got %v", v)
+	}
+
+	table.AddBytes("b", 0, []byte("FCGZ\x1f\x8b"))
+	table.FlushMemory()
+	if b, err := table.GetBytes("b"); err != nil || string(b) != "FCGZ\x1f\x8b" {
+		t.Errorf("GetBytes returned %q %v", b, err)
+	}
+}
@@ -1,7 +1,12 @@
 package filecache
 
 import (
+	"context"
+	"crypto/md5"
 	"fmt"
+	"hash"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -27,12 +32,109 @@ type CacheTableConfig struct {
 	DiscExpiryInterval time.Duration
 	// The queue size for persistence. Default is 1
 	PersistQueueSize int
+	// Optional limit on the total number of bytes waiting in the persistence queue.
+	// When set Add will block until enough queued entries have been written to disk.
+	// A single entry larger than this limit is still accepted once the queue is empty.
+	MaxQueuedBytes int
+	// The maximum time Stop will wait for queued entries to be written to disk.
+	// If not set then Stop waits until the queue has been fully drained.
+	StopTimeout time.Duration
+	// Optional period to hold entries before persisting them.
+	// If the same key is written again within this period then only the latest value is written to disk.
+	PersistDebounce time.Duration
 	// Optional dataLoader called when a key doesn't exist in either memory or disk
 	DataLoader CacheDataLoader
+	// Optional dataLoader which is passed the context.Context of the Get. If set then DataLoader is ignored
+	DataLoaderContext CacheDataLoaderContext
+	// Optional time before an item expires from memory when a Get will refresh it in the background
+	// via the DataLoader. The current value is returned whilst the refresh takes place.
+	RefreshAhead time.Duration
+	// If true then when the DataLoader returns an error Get will return a copy from disk,
+	// even if it has expired, rather than the error.
+	ServeStaleOnError bool
+	// Optional time to remember that the DataLoader could not find a key.
+	// Within this time Get returns ErrKeyNotFound for that key without checking the disk or calling
+	// the DataLoader. Adding the key clears this.
+	NegativeTTL time.Duration
 	// Optional callback called when an item is added
 	AddItem CacheItemCallback
 	// Optional callback called when an item is about to be removed from memory (but not disk)
 	DeleteItem CacheItemCallback
+	// Optional callback called when an entry fails to be written to disk,
+	// including when ToBytes fails to encode it
+	PersistError CacheErrorCallback
+	// Optional callback called when an entry is removed from disk by expiry, the disk quota or flushing
+	OnDiskEvict CacheKeyCallback
+	// If true then the table's directory is not created until the first entry is persisted.
+	// This prevents empty directories being left around for tables that are never used.
+	LazyDirCreate bool
+	// If true then Get returns a deep copy of the value, made by passing it through ToBytes & FromBytes,
+	// so that callers mutating the returned value do not affect the cached copy.
+	// This adds the cost of serializing & deserializing the value on every Get.
+	CopyOnRead bool
+	// If true then files are stored under a hash of the key rather than the key itself,
+	// with the key recorded at the start of the file.
+	// This allows keys longer than the filesystem's filename limit.
+	HashFilenames bool
+	// Optional hash used to calculate the directory an entry is stored under.
+	// If not supplied then md5 is used. Changing this on an existing cache will make
+	// existing entries on disk unreachable.
+	HashFunc func() hash.Hash
+	// How entries are compressed on disk. Default is NoCompression
+	Compression Compression
+	// Optional Cipher used to encrypt entries on disk.
+	// Entries which fail to decrypt are treated as missing.
+	Cipher *Cipher
+	// Optional limit on the number of items held in memory.
+	// When exceeded the least recently accessed items are removed from memory but kept on disk.
+	MaxMemoryItems int
+	// Optional limit on the total size of the disk cache.
+	// When exceeded the oldest entries are removed from both disk & memory when the disk cache is expired.
+	MaxDiskBytes int64
+	// Optional Clock for this table. Defaults to the Clock of the Cache
+	Clock Clock
+	// If true then nothing is written to or read from disk, the table only holds items in memory
+	MemoryOnly bool
+	// Optional permissions for files written to disk. Defaults to DefaultFileMode
+	FileMode os.FileMode
+	// Optional permissions for directories created on disk. Defaults to the DirMode of the Cache
+	DirMode os.FileMode
+	// The number of goroutines used to process files when expiring or flushing the disk cache.
+	// Default is 1
+	WalkConcurrency int
+	// Optional Logger for this table. Defaults to the Logger of the Cache
+	Logger Logger
+	// Optional Codecs, keyed by name, used by AddWithCodec to store values of different types in this table.
+	// The name is stored on disk so must not change whilst entries using it exist.
+	Codecs map[string]Codec
+	// The policy used when an entry is persisted whilst the persistence queue is full.
+	// Default is PersistBlock. Entries which are dropped remain in memory but are not written to disk.
+	PersistOverflow PersistOverflow
+	// The policy used to expire items from memory. Default is SinceAccess, where an item expires
+	// lifeSpan after it was last accessed. SinceCreation expires items lifeSpan after they were created.
+	ExpiryPolicy ExpiryPolicy
+	// The number of directory levels entries are spread across on disk.
+	// If FanoutWidth is set then 0 stores all entries in the table's directory.
+	FanoutDepth int
+	// The number of hex characters of the key's hash used to name each directory level.
+	// Defaults to 2 if FanoutDepth is set. If neither are set then the default layout is used,
+	// 2 levels of 1 then 2 characters giving 4096 directories.
+	// Changing the layout of an existing cache will make existing entries on disk unreachable.
+	FanoutWidth int
+	// If true then entries are written to disk before Add returns rather than being queued,
+	// with AddErr & AddExpiryErr returning any write error.
+	// This trades throughput for durability.
+	SyncPersist bool
+	// Optional limit on how many DataLoader calls can run at the same time.
+	// Gets which need to call the DataLoader whilst at this limit wait for one to complete.
+	MaxConcurrentLoads int
+	// The number of goroutines writing entries to disk. Default is 1.
+	// Entries for the same key are always written by the same goroutine so remain in order.
+	PersistWorkers int
+	// If true then the keys on disk are held in memory so Exists & NotFoundAdd don't need to check the disk.
+	// The index is built by walking the disk when the table starts, until then the disk is checked.
+	// The index holds every key on disk so uses memory proportional to the size of the disk cache.
+	IndexDisk bool
 }
 
 const (
@@ -48,15 +150,49 @@ const (
 )
 
 // AddCache adds a new CacheTable to the cache.
-// If a cache of the same name exists then this will return an error
+// If a cache of the same name exists, or the name is not a valid key, then this will return an error
 func (c *Cache) AddCache(cfg CacheTableConfig) (*CacheTable, error) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
 	if _, exists := c.tables[cfg.Name]; exists {
+		c.mutex.Unlock()
 		return nil, fmt.Errorf("cache %s already exists", cfg.Name)
 	}
 
+	t, err := c.addCache(cfg)
+	added := c.tableAdded
+	c.mutex.Unlock()
+
+	// Outside the lock so the hook can use the cache
+	added.call(t)
+	return t, err
+}
+
+// GetOrCreateCache returns the named CacheTable if it already exists, otherwise it creates it.
+// Unlike calling GetCache then AddCache this is atomic so is safe to call concurrently.
+// If the table already exists then cfg is ignored.
+func (c *Cache) GetOrCreateCache(cfg CacheTableConfig) (*CacheTable, error) {
+	c.mutex.Lock()
+	if t, exists := c.tables[cfg.Name]; exists {
+		c.mutex.Unlock()
+		return t, nil
+	}
+
+	t, err := c.addCache(cfg)
+	added := c.tableAdded
+	c.mutex.Unlock()
+
+	added.call(t)
+	return t, err
+}
+
+func (c *Cache) addCache(cfg CacheTableConfig) (*CacheTable, error) {
+	// Careful: do not run this method unless the cache-mutex is locked!
+
+	// The name is used as the table's directory so must be valid as a key
+	if !validKey(cfg.Name) {
+		return nil, fmt.Errorf("cache %q: %w", cfg.Name, ErrInvalidKey)
+	}
+
 	toBytes := cfg.ToBytes
 	if toBytes == nil {
 		toBytes = ToJsonBytes
@@ -77,6 +213,56 @@ func (c *Cache) AddCache(cfg CacheTableConfig) (*CacheTable, error) {
 		diskExpiryTime = 24 * time.Hour
 	}
 
+	dataLoader := cfg.DataLoaderContext
+	if dataLoader == nil && cfg.DataLoader != nil {
+		dataLoader = func(_ context.Context, key string, args ...interface{}) (*CacheItem, error) {
+			return cfg.DataLoader(key, args...)
+		}
+	}
+
+	clock := cfg.Clock
+	if clock == nil {
+		clock = c.clock
+	}
+
+	fileMode := cfg.FileMode
+	if fileMode == 0 {
+		fileMode = DefaultFileMode
+	}
+
+	dirMode := cfg.DirMode
+	if dirMode == 0 {
+		dirMode = c.dirMode
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = c.logger
+	}
+
+	hashFunc := cfg.HashFunc
+	if hashFunc == nil {
+		hashFunc = md5.New
+	}
+
+	fanoutWidth := cfg.FanoutWidth
+	if fanoutWidth <= 0 && cfg.FanoutDepth > 0 {
+		fanoutWidth = 2
+	}
+
+	fanout := []int{1, 2}
+	if fanoutWidth > 0 {
+		fanout = make([]int, 0, cfg.FanoutDepth)
+		for i := 0; i < cfg.FanoutDepth; i++ {
+			fanout = append(fanout, fanoutWidth)
+		}
+	}
+
+	var loadSlots chan struct{}
+	if cfg.MaxConcurrentLoads > 0 {
+		loadSlots = make(chan struct{}, cfg.MaxConcurrentLoads)
+	}
+
 	diskExpiryInterval := cfg.DiscExpiryInterval
 	if diskExpiryInterval <= 0 {
 		diskExpiryInterval = time.Hour
@@ -85,28 +271,63 @@ func (c *Cache) AddCache(cfg CacheTableConfig) (*CacheTable, error) {
 	t := &CacheTable{
 		parent:             c,
 		name:               cfg.Name,
+		basePath:           c.cacheDir + PathSeparator + cfg.Name,
 		items:              make(map[string]*CacheItem),
 		toBytes:            toBytes,
 		fromBytes:          cfg.FromBytes,
 		startupOptions:     cfg.StartupOptions,
 		expiryTime:         expiryTime,
+		persistQueueSize:   persistQueueSize,
 		persistQueue:       make(chan persistEntry, persistQueueSize),
+		stopTimeout:        cfg.StopTimeout,
 		diskExpiryInterval: diskExpiryInterval,
 		diskExpiryTime:     diskExpiryTime,
-		dataLoader:         cfg.DataLoader,
+		dataLoader:         dataLoader,
 		addItem:            cfg.AddItem,
 		deleteItem:         cfg.DeleteItem,
+		persistError:       cfg.PersistError,
+		lazyDirCreate:      cfg.LazyDirCreate,
+		maxQueuedBytes:     cfg.MaxQueuedBytes,
+		copyOnRead:         cfg.CopyOnRead,
+		hashFilenames:      cfg.HashFilenames,
+		hashFunc:           hashFunc,
+		compression:        cfg.Compression,
+		cipher:             cfg.Cipher,
+		maxMemoryItems:     cfg.MaxMemoryItems,
+		maxDiskBytes:       cfg.MaxDiskBytes,
+		loadCalls:          make(map[string]*loadCall),
+		clock:              clock,
+		memoryOnly:         cfg.MemoryOnly,
+		fs:                 c.fs,
+		persistDebounce:    cfg.PersistDebounce,
+		fileMode:           fileMode,
+		dirMode:            dirMode,
+		onDiskEvict:        cfg.OnDiskEvict,
+		walkConcurrency:    cfg.WalkConcurrency,
+		refreshAheadTime:   cfg.RefreshAhead,
+		serveStaleOnError:  cfg.ServeStaleOnError,
+		negativeTTL:        cfg.NegativeTTL,
+		logger:             logger,
+		codecs:             cfg.Codecs,
+		persistOverflow:    cfg.PersistOverflow,
+		expiryPolicy:       cfg.ExpiryPolicy,
+		fanout:             fanout,
+		syncPersist:        cfg.SyncPersist,
+		loadSlots:          loadSlots,
+		persistWorkers:     cfg.PersistWorkers,
+		indexDisk:          cfg.IndexDisk,
 	}
-
-	c.tables[t.name] = t
+	t.queueCond = sync.NewCond(&t.queueMutex)
 
 	// Start the cache if we have already started
-	if c.started {
+	if c.started.Load() {
 		err := t.start()
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	c.tables[t.name] = t
+
 	return t, nil
 }
@@ -1,24 +1,151 @@
 package filecache
 
 import (
-	"crypto/md5"
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	PathSeparator = string(os.PathSeparator)
+	// The default permissions for files written to disk
+	DefaultFileMode os.FileMode = 0644
+	// The default permissions for directories created on disk
+	DefaultDirMode os.FileMode = 0755
 )
 
 func (table *CacheTable) getPath(key string) (string, string) {
-	h := md5.New()
+	h := table.hashFunc()
 	_, _ = h.Write([]byte(key))
 	b := hex.EncodeToString(h.Sum(nil))
-	return table.basePath + PathSeparator + b[0:1] + PathSeparator + b[1:3], key
+	dir := table.basePath
+	i := 0
+	for _, w := range table.fanout {
+		if i+w > len(b) {
+			break
+		}
+		dir = dir + PathSeparator + b[i:i+w]
+		i += w
+	}
+	if table.hashFilenames {
+		return dir, b
+	}
+	return dir, key
+}
+
+// keyMagic prefixes the key header stored at the start of each file
+var keyMagic = []byte("FCK1")
+
+// maxKeyLen is the longest key accepted when reading a key header
+const maxKeyLen = 1 << 16
+
+// encodeFile returns the content of a file to be written to disk.
+// This is prefixed with the key so it can be recovered regardless of the filename.
+func (table *CacheTable) encodeFile(key string, val []byte) []byte {
+	l := len(keyMagic) + binary.MaxVarintLen64
+	b := make([]byte, l, l+len(key)+len(val))
+	n := copy(b, keyMagic)
+	n += binary.PutUvarint(b[n:], uint64(len(key)))
+	b = append(b[:n], key...)
+	return append(b, val...)
+}
+
+// decodeFile returns the value from the content of a file read from disk.
+// Files written before every file had a key header have none, which is only valid if the filename is the key.
+// A header which has been truncated, or a value without the metadata always written after the key header,
+// returns ErrCorrupt.
+func (table *CacheTable) decodeFile(key string, b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, keyMagic) {
+		switch {
+		case truncatedMagic(b):
+			return nil, ErrCorrupt
+		case table.hashFilenames:
+			return nil, fmt.Errorf("no key header for %q", key)
+		default:
+			return b, nil
+		}
+	}
+	b = b[len(keyMagic):]
+
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return nil, ErrCorrupt
+	}
+
+	// Guard against hash collisions
+	if string(b[n:n+int(l)]) != key {
+		return nil, fmt.Errorf("key mismatch for %q", key)
+	}
+
+	b = b[n+int(l):]
+	if !bytes.HasPrefix(b, metaMagic) {
+		return nil, ErrCorrupt
+	}
+	return b, nil
+}
+
+// truncatedMagic returns true if b starts like keyMagic but doesn't have all of it,
+// so is a file truncated within its key header rather than one written without a header.
+func truncatedMagic(b []byte) bool {
+	return bytes.HasPrefix(b, keyMagic[:len(keyMagic)-1]) && !bytes.HasPrefix(b, keyMagic)
+}
+
+// corruptOnEOF returns ErrCorrupt if err is from a header ending early, otherwise err
+func corruptOnEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupt
+	}
+	return err
+}
+
+// readFileKey reads the key from the header at the start of a file
+func (table *CacheTable) readFileKey(path string) (string, error) {
+	f, err := table.fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	key, ok, err := table.readKeyHeader(bufio.NewReader(f))
+	if err == nil && !ok {
+		err = fmt.Errorf("no key header in %q", path)
+	}
+	return key, err
+}
+
+// readKeyHeader reads the key header from the start of a file.
+// ok is false if the file has no key header, in which case nothing is read.
+func (table *CacheTable) readKeyHeader(r *bufio.Reader) (key string, ok bool, err error) {
+	if magic, _ := r.Peek(len(keyMagic)); !bytes.Equal(magic, keyMagic) {
+		if truncatedMagic(magic) {
+			return "", false, ErrCorrupt
+		}
+		return "", false, nil
+	}
+	_, _ = r.Discard(len(keyMagic))
+
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", false, corruptOnEOF(err)
+	}
+	if l > maxKeyLen {
+		return "", false, ErrCorrupt
+	}
+
+	b := make([]byte, l)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return "", false, corruptOnEOF(err)
+	}
+	return string(b), true, nil
 }
 
 func (table *CacheTable) getFilePath(key string) string {
@@ -28,25 +155,121 @@ func (table *CacheTable) getFilePath(key string) string {
 
 type walkFunc func(key, path string, info os.FileInfo, err error) error
 
+// tempFunc is called by walkTemp for each temporary file
+type tempFunc func(path string, info os.FileInfo)
+
 func (table *CacheTable) walk(f walkFunc) error {
-	return filepath.Walk(table.basePath, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			key := strings.SplitN(path, PathSeparator, 3)
-			if len(key) == 3 {
-				err = f(key[2], path, info, err)
-				return err
+	return table.walkTemp(f, nil)
+}
+
+// walkTemp is the same as walk but also calls temp, if not nil, for each temporary file
+func (table *CacheTable) walkTemp(f walkFunc, temp tempFunc) error {
+	if table.memoryOnly {
+		return nil
+	}
+
+	return table.fs.Walk(table.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// basePath won't exist until the first write if lazyDirCreate is set
+			if os.IsNotExist(err) {
+				return nil
 			}
+			table.recordError(err)
+			return err
 		}
 
-		return nil
+		// Skip directories & temporary files, which start with "." so can never be a valid key
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if temp != nil {
+				temp(path, info)
+			}
+			return nil
+		}
+
+		// The filename is the key unless hashFilenames is set, in which case it is read from the key header
+		key := filepath.Base(path)
+		if table.hashFilenames {
+			key, err = table.readFileKey(path)
+			if err != nil {
+				table.recordError(err)
+				return nil
+			}
+		}
+
+		return f(key, path, info, err)
 	})
 }
 
+// walkParallel is the same as walk but calls f from walkConcurrency goroutines so files are
+// processed in parallel. f must be safe to call concurrently.
+// The first error returned by f stops the walk and is returned.
+func (table *CacheTable) walkParallel(f walkFunc) error {
+	return table.walkParallelTemp(f, nil)
+}
+
+// walkParallelTemp is the same as walkParallel but also calls temp, if not nil, for each temporary file.
+// Unlike f, temp is called from the walking goroutine.
+func (table *CacheTable) walkParallelTemp(f walkFunc, temp tempFunc) error {
+	if table.walkConcurrency <= 1 {
+		return table.walkTemp(f, temp)
+	}
+
+	type walkJob struct {
+		key, path string
+		info      os.FileInfo
+	}
+
+	jobs := make(chan walkJob)
+	done := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+
+	for i := 0; i < table.walkConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := f(j.key, j.path, j.info, nil); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(done)
+					})
+				}
+			}
+		}()
+	}
+
+	err := table.walkTemp(func(key, path string, info os.FileInfo, err error) error {
+		select {
+		case jobs <- walkJob{key: key, path: path, info: info}:
+			return nil
+		case <-done:
+			return firstErr
+		}
+	}, temp)
+
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return err
+}
+
+// loadBatchSize is the number of items loadCache reads from disk before adding them to memory
+const loadBatchSize = 100
+
+// loadCache loads entries from disk into memory.
+// Files are read without the table-mutex being locked, only taking it to add each batch of
+// loaded items so the table remains responsive during a large load.
 func (table *CacheTable) loadCache(maxAge time.Duration) {
 	table.stopDiskExpiryTimer()
-	table.mutex.Lock()
 	defer func() {
-		table.mutex.Unlock()
 		table.startDiskExpiryTimer()
 		table.expireMemory()
 	}()
@@ -54,28 +277,87 @@ func (table *CacheTable) loadCache(maxAge time.Duration) {
 	if maxAge > 0 {
 		maxAge = -maxAge
 	}
-	loadTime := time.Now().Add(maxAge)
+	loadTime := table.now().Add(maxAge)
+
+	batch := make([]*CacheItem, 0, loadBatchSize)
+	addBatch := func() {
+		table.mutex.Lock()
+		defer table.mutex.Unlock()
+		for _, item := range batch {
+			// Don't replace anything added whilst we were loading
+			if _, exists := table.items[item.key]; !exists {
+				table.setItem(item)
+			}
+		}
+		table.evictLRU()
+		batch = batch[:0]
+	}
 
 	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
 
 		if maxAge == 0 || info.ModTime().After(loadTime) {
-			item := table.diskLoader(key)
+			// LoadEntireCacheOnStart loads entries regardless of age so includes those past the disk expiry time
+			item, expired := table.readDisk(key, maxAge == 0)
+			if expired {
+				table.expireDiskKey(key)
+			}
 			if item != nil {
-				table.items[key] = item
+				batch = append(batch, item)
+				if len(batch) >= loadBatchSize {
+					addBatch()
+				}
 			}
 		}
 
 		return nil
 	})
+
+	addBatch()
+}
+
+// Warm loads the named keys from disk into memory, returning how many were loaded.
+// Keys which are invalid, already in memory or not on disk are ignored.
+// Unlike LoadCacheOnStart this allows known hot keys to be loaded without loading the entire cache.
+func (table *CacheTable) Warm(keys ...string) int {
+	var items []*CacheItem
+	for _, key := range keys {
+		if !validKey(key) || table.ExistsInMemory(key) {
+			continue
+		}
+		item, expired := table.diskLoader(key)
+		if expired {
+			table.expireDiskKey(key)
+		}
+		if item != nil {
+			items = append(items, item)
+		}
+	}
+
+	loaded := 0
+	table.mutex.Lock()
+	for _, item := range items {
+		// Don't replace anything added whilst we were loading
+		if _, exists := table.items[item.key]; !exists {
+			table.setItem(item)
+			loaded++
+		}
+	}
+	table.evictLRU()
+	table.mutex.Unlock()
+
+	if loaded > 0 {
+		table.expireMemory()
+	}
+	return loaded
 }
 
 func (c *Cache) initCacheDir() error {
-	err := os.MkdirAll(c.cacheDir, 0777)
+	err := c.fs.MkdirAll(c.cacheDir, c.dirMode)
 	if err != nil {
 		return err
 	}
 
-	stat, err := os.Stat(c.cacheDir)
+	stat, err := c.fs.Stat(c.cacheDir)
 	if err != nil {
 		return err
 	}
@@ -83,15 +365,68 @@ func (c *Cache) initCacheDir() error {
 		return fmt.Errorf("%s is not a directory", c.cacheDir)
 	}
 
-	// Test we can write to it
-	tmpName := c.cacheDir + PathSeparator + "__tmpfile__"
-	tmpFile, err := os.Create(tmpName)
+	return probeWritable(c.fs, c.cacheDir)
+}
+
+// probeWritable tests we can write to a directory by writing then removing a temporary file.
+// The file starts with "." so is ignored by walk.
+func probeWritable(fs Filesystem, dir string) error {
+	tmpName := dir + PathSeparator + ".__tmpfile__"
+	err := fs.WriteFile(tmpName, nil, DefaultFileMode)
 	if err != nil {
 		return err
 	}
-	err = tmpFile.Close()
-	if err != nil {
-		return err
+	return fs.Remove(tmpName)
+}
+
+// DiskCount returns how many items are on disk.
+// Unlike Count this has to walk the disk.
+func (table *CacheTable) DiskCount() int {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	count := 0
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		count++
+		return nil
+	})
+	table.lastDiskCount.Store(int64(count))
+	return count
+}
+
+// DiskCountEstimate returns how many items are on disk without walking the disk, so is cheap
+// enough to call when exporting metrics.
+// With IndexDisk this is the number of keys in the index, otherwise it is the count found by the
+// last DiskCount or disk expiry so may be out of date, or 0 if neither has run.
+func (table *CacheTable) DiskCountEstimate() int {
+	if count, ok := table.indexCount(); ok {
+		return count
 	}
-	return os.Remove(tmpName)
+	return int(table.lastDiskCount.Load())
+}
+
+// AgeHistogram walks the disk cache once and counts each file into an age bucket.
+// buckets must be in ascending order. The returned slice has len(buckets)+1 entries,
+// entry i counting files younger than buckets[i] (and not in an earlier bucket) with
+// the final entry counting files older than the last bucket.
+//
+// e.g. buckets of 1h, 6h, 24h gives counts for <1h, 1-6h, 6-24h & >24h
+func (table *CacheTable) AgeHistogram(buckets []time.Duration) []int {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	counts := make([]int, len(buckets)+1)
+	now := table.now()
+
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		age := now.Sub(info.ModTime())
+		i := 0
+		for i < len(buckets) && age >= buckets[i] {
+			i++
+		}
+		counts[i]++
+		return nil
+	})
+
+	return counts
 }
@@ -0,0 +1,529 @@
+package filecache
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAgeHistogram(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	now := time.Now()
+	ages := map[string]time.Duration{
+		"a": 10 * time.Minute,
+		"b": 2 * time.Hour,
+		"c": 3 * time.Hour,
+		"d": 12 * time.Hour,
+		"e": 48 * time.Hour,
+		"f": 72 * time.Hour,
+		"g": 100 * time.Hour,
+	}
+	for key, age := range ages {
+		table.Add(key, "v")
+		setModTime(t, table, key, now.Add(-age))
+	}
+
+	got := table.AgeHistogram([]time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour})
+	if expected := []int{1, 2, 1, 3}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestWalk_multiSegmentCacheDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "a", "b", "c")
+	table := newTestTables(t, CacheConfig{CacheDir: dir}, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})[0]
+
+	table.Add("key", "v")
+
+	var keys []string
+	table.ForeachDisk(func(key string, item *CacheItem) {
+		keys = append(keys, key)
+	})
+	if !reflect.DeepEqual(keys, []string{"key"}) {
+		t.Errorf("walked keys %q, expected [key]", keys)
+	}
+}
+
+func TestHashFilenames_longKey(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, HashFilenames: true})
+
+	key := strings.Repeat("k", 2048)
+	if table.Add(key, "v") == nil {
+		t.Fatal("Add failed")
+	}
+	if _, err := table.LastError(); err != nil {
+		t.Fatal(err)
+	}
+
+	table.FlushMemory()
+	item, source, err := table.GetWithSource(key)
+	if err != nil || source != SourceDisk || item.Data() != "v" {
+		t.Fatalf("GetWithSource %v %v %v", item, source, err)
+	}
+
+	var keys []string
+	table.ForeachDisk(func(k string, item *CacheItem) {
+		keys = append(keys, k)
+	})
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("ForeachDisk did not return the long key")
+	}
+}
+
+func TestHashFunc_sha256(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, HashFunc: sha256.New})
+
+	table.Add("key", "v")
+
+	sum := sha256.Sum256([]byte("key"))
+	b := hex.EncodeToString(sum[:])
+	if _, err := os.Stat(filepath.Join(table.basePath, b[0:1], b[1:3], "key")); err != nil {
+		t.Fatal(err)
+	}
+
+	table.FlushMemory()
+	if v := mustGet(t, table, "key"); v != "v" {
+		t.Errorf("got %v", v)
+	}
+}
+
+func TestDiskCount(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	for i := 0; i < 5; i++ {
+		table.Add(fmt.Sprintf("k%d", i), "v")
+	}
+	table.FlushMemory()
+
+	if n := table.Count(); n != 0 {
+		t.Errorf("Count %d, expected 0", n)
+	}
+	if n := table.DiskCount(); n != 5 {
+		t.Errorf("DiskCount %d, expected 5", n)
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+
+	// Modes which a typical umask does not alter
+	table := newTestTables(t, CacheConfig{CacheDir: filepath.Join(t.TempDir(), "cache"), DirMode: 0750},
+		CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, FileMode: 0600, DirMode: 0700},
+	)[0]
+	table.Add("k", "v")
+
+	path := table.getFilePath("k")
+	for name, expected := range map[string]os.FileMode{
+		table.parent.cacheDir: 0750,
+		table.basePath:        0700,
+		filepath.Dir(path):    0700,
+		path:                  0600,
+	} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != expected {
+			t.Errorf("%s has mode %v, expected %v", name, mode, expected)
+		}
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, WalkConcurrency: 8})
+
+	for i := 0; i < 200; i++ {
+		table.Add(fmt.Sprintf("k%d", i), "v")
+	}
+
+	var mutex sync.Mutex
+	visits := make(map[string]int)
+	err := table.walkParallel(func(key, path string, info os.FileInfo, err error) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		visits[key]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(visits) != 200 {
+		t.Errorf("visited %d keys, expected 200", len(visits))
+	}
+	for key, n := range visits {
+		if n != 1 {
+			t.Errorf("%q visited %d times", key, n)
+		}
+	}
+
+	// The first error stops the walk & is returned
+	stop := errors.New("stop")
+	if err := table.walkParallel(func(key, path string, info os.FileInfo, err error) error {
+		return stop
+	}); err != stop {
+		t.Errorf("walkParallel returned %v, expected %v", err, stop)
+	}
+}
+
+func BenchmarkWalkParallel(b *testing.B) {
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			table := newTestTable(b, CacheTableConfig{
+				StartupOptions:  noStartup,
+				SyncPersist:     true,
+				WalkConcurrency: concurrency,
+			})
+			for i := 0; i < 2000; i++ {
+				table.Add(fmt.Sprintf("k%d", i), "v")
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// Reading each file's metadata, as ExpireDisk does, is what benefits from concurrency
+				_ = table.walkParallel(func(key, path string, info os.FileInfo, err error) error {
+					_, _ = table.readFileMeta(path)
+					return nil
+				})
+			}
+		})
+	}
+}
+
+func TestLoadCache_doesNotBlockGets(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		FromBytes: func(b []byte) interface{} {
+			// Slow decoding so the load takes a while
+			time.Sleep(2 * time.Millisecond)
+			return string(b)
+		},
+	})
+
+	for i := 0; i < 300; i++ {
+		table.Add(fmt.Sprintf("k%d", i), "v")
+	}
+	table.FlushMemory()
+	table.Add("hot", "v")
+
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		table.loadCache(0)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		mustGet(t, table, "hot")
+	}
+
+	select {
+	case <-loaded:
+		t.Fatal("Get was blocked until the load completed")
+	default:
+	}
+
+	<-loaded
+	if n := table.Count(); n != 301 {
+		t.Errorf("Count %d after load, expected 301", n)
+	}
+}
+
+func TestChecksum_corruptFileIsRemoved(t *testing.T) {
+	logger := &captureLogger{}
+	table := newTestTables(t, CacheConfig{Logger: logger},
+		CacheTableConfig{StartupOptions: noStartup, SyncPersist: true},
+	)[0]
+
+	table.Add("k", "a value long enough to corrupt")
+	table.FlushMemory()
+
+	path := table.getFilePath("k")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := table.Get("k"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v, expected %v", err, ErrKeyNotFound)
+	}
+	if _, err := table.LastError(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("LastError %v, expected %v", err, ErrCorrupt)
+	}
+	if !logger.contains(ErrCorrupt.Error()) {
+		t.Error("corruption not logged")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupt file not removed: %v", err)
+	}
+}
+
+func TestChecksum_truncatedFileIsRemoved(t *testing.T) {
+	// Truncated within the key magic, the key header, just after it & within the metadata
+	for _, n := range []int{3, 5, 6, 8, 12} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+			table.Add("k", "a value")
+			table.FlushMemory()
+
+			path := table.getFilePath("k")
+			if err := os.Truncate(path, int64(n)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := table.Get("k"); err != ErrKeyNotFound {
+				t.Errorf("Get returned %v, expected %v", err, ErrKeyNotFound)
+			}
+			if _, err := table.LastError(); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("LastError %v, expected %v", err, ErrCorrupt)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("truncated file not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestForeachDiskData(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		table.Add(key, "value "+key)
+	}
+	table.FlushMemory()
+
+	values := make(map[string]interface{})
+	table.ForeachDiskData(func(key string, item *CacheItem) {
+		values[key] = item.Data()
+	})
+	if len(values) != 5 {
+		t.Errorf("visited %d entries, expected 5", len(values))
+	}
+	for key, v := range values {
+		if v != "value "+key {
+			t.Errorf("%q got %v", key, v)
+		}
+	}
+
+	// ForeachDisk only provides metadata
+	table.ForeachDisk(func(key string, item *CacheItem) {
+		if item.Data() != nil {
+			t.Errorf("%q has data %v", key, item.Data())
+		}
+	})
+}
+
+func TestFanout(t *testing.T) {
+	sum := md5.Sum([]byte("key"))
+	b := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		depth, width int
+		dir          string
+	}{
+		{depth: 0, width: 2, dir: ""},
+		{depth: 1, width: 2, dir: b[0:2]},
+		{depth: 3, width: 2, dir: filepath.Join(b[0:2], b[2:4], b[4:6])},
+		{depth: 2, width: 3, dir: filepath.Join(b[0:3], b[3:6])},
+		// The width defaults to 2 when only the depth is set
+		{depth: 2, width: 0, dir: filepath.Join(b[0:2], b[2:4])},
+		{depth: 0, width: 0, dir: filepath.Join(b[0:1], b[1:3])},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("depth%dwidth%d", tt.depth, tt.width), func(t *testing.T) {
+			table := newTestTable(t, CacheTableConfig{
+				StartupOptions: noStartup,
+				SyncPersist:    true,
+				FanoutDepth:    tt.depth,
+				FanoutWidth:    tt.width,
+			})
+
+			table.Add("key", "v")
+			if _, err := os.Stat(filepath.Join(table.basePath, tt.dir, "key")); err != nil {
+				t.Fatal(err)
+			}
+
+			table.FlushMemory()
+			if keys := table.Keys(); len(keys) != 1 || keys[0] != "key" {
+				t.Errorf("Keys returned %v, expected [key]", keys)
+			}
+			if v := mustGet(t, table, "key"); v != "v" {
+				t.Errorf("got %v", v)
+			}
+		})
+	}
+}
+
+func TestWarm(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	for i := 0; i < 5; i++ {
+		table.Add(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	table.FlushMemory()
+	table.Add("mem", "v")
+
+	if n := table.Warm("k1", "k3", "mem", "missing"); n != 2 {
+		t.Errorf("Warm loaded %d, expected 2", n)
+	}
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if resident := table.ExistsInMemory(key); resident != (i == 1 || i == 3) {
+			t.Errorf("%q in memory %v", key, resident)
+		}
+	}
+	if v := mustGet(t, table, "k3"); v != "v3" {
+		t.Errorf("got %v, expected v3", v)
+	}
+}
+
+func TestHashFilenames_walkRecoversKeys(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, HashFilenames: true})
+
+	keys := []string{"a", "with space", "UPPER-lower", "k.json"}
+	for _, key := range keys {
+		table.Add(key, "v:"+key)
+		if name := filepath.Base(table.getFilePath(key)); name == key {
+			t.Errorf("filename of %q is not hashed", key)
+		}
+	}
+	table.FlushMemory()
+
+	got := table.Keys()
+	sort.Strings(got)
+	expected := append([]string(nil), keys...)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Keys returned %q, expected %q", got, expected)
+	}
+
+	table.ForeachDiskData(func(key string, item *CacheItem) {
+		if item.Key() != key || item.Data() != "v:"+key {
+			t.Errorf("ForeachDiskData %q returned %q %v", key, item.Key(), item.Data())
+		}
+	})
+}
+
+func TestHashFilenames_noKeyHeader(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, HashFilenames: true})
+
+	// A key header without keyMagic is not recognised so the hashed filename can't be mapped back to its key
+	dir, _ := table.getPath("legacy")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := append([]byte{byte(len("legacy"))}, "legacyv"...)
+	if err := os.WriteFile(table.getFilePath("legacy"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := table.Keys(); len(keys) != 0 {
+		t.Errorf("Keys returned %q, expected none", keys)
+	}
+	if _, err := table.Get("legacy"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v, expected %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestIndexDisk_existsWithoutStat(t *testing.T) {
+	fs := &testFS{}
+	table := newTestTables(t, CacheConfig{Filesystem: fs},
+		CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, IndexDisk: true},
+	)[0]
+	cache := table.parent
+
+	// Restart so the index is built from what is already on disk
+	table.Add("before", "v")
+	cache.Stop()
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, ok := table.indexLookup("before"); !ok; _, ok = table.indexLookup("before") {
+		if time.Now().After(deadline) {
+			t.Fatal("disk index not built")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	table.Add("after", "v")
+	table.Add("deleted", "v")
+	table.DeleteFromMemoryAndDisk("deleted")
+	table.FlushMemory()
+
+	fs.stats.Store(0)
+	for key, exists := range map[string]bool{"before": true, "after": true, "deleted": false, "missing": false} {
+		if table.Exists(key) != exists {
+			t.Errorf("Exists(%q) %v, expected %v", key, !exists, exists)
+		}
+	}
+	if table.NotFoundAdd("before", "v") {
+		t.Error("NotFoundAdd added a key on disk")
+	}
+	if n := fs.stats.Load(); n != 0 {
+		t.Errorf("disk checked %d times", n)
+	}
+}
+
+func TestDiskCountEstimate(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{Name: "walked", StartupOptions: noStartup, SyncPersist: true},
+		CacheTableConfig{Name: "indexed", StartupOptions: noStartup, SyncPersist: true, IndexDisk: true},
+	)
+	walked, indexed := tables[0], tables[1]
+	deadline := time.Now().Add(5 * time.Second)
+	for _, ok := indexed.indexCount(); !ok; _, ok = indexed.indexCount() {
+		if time.Now().After(deadline) {
+			t.Fatal("disk index not built")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, table := range tables {
+		table.Add("a", "v")
+		table.Add("b", "v")
+		table.Add("c", "v")
+		table.DeleteFromMemoryAndDisk("c")
+	}
+
+	// Without an index nothing is known until the disk is walked
+	if n := walked.DiskCountEstimate(); n != 0 {
+		t.Errorf("walked estimate %d before a walk, expected 0", n)
+	}
+	walked.DiskCount()
+	walked.Add("d", "v")
+	if n := walked.DiskCountEstimate(); n != 2 {
+		t.Errorf("walked estimate %d, expected 2 from the last walk", n)
+	}
+	walked.DeleteFromMemory("a")
+	setModTime(t, walked, "a", time.Now().Add(-2*time.Hour))
+	walked.ExpireDiskMaxAge(time.Hour)
+	if n := walked.DiskCountEstimate(); n != 2 {
+		t.Errorf("walked estimate %d after expiry, expected 2", n)
+	}
+
+	if n := indexed.DiskCountEstimate(); n != 2 {
+		t.Errorf("indexed estimate %d, expected 2", n)
+	}
+}
@@ -0,0 +1,41 @@
+package filecache
+
+import (
+	"os"
+)
+
+// DrainTo moves all entries in this table, both in memory and on disk, into dest.
+// Entries are decoded with this table's FromBytes and re-added to dest so they are
+// persisted with dest's ToBytes and expiry time.
+// Entries are only removed from this table once dest has accepted them.
+// Returns the number of entries moved.
+func (table *CacheTable) DrainTo(dest *CacheTable) int {
+	entries := make(map[string]interface{})
+
+	table.mutex.RLock()
+	for key, item := range table.items {
+		entries[key] = item.Data()
+	}
+	table.mutex.RUnlock()
+
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		if _, exists := entries[key]; !exists {
+			// Expired entries are skipped, they are left for ExpireDisk
+			item, _ := table.diskLoader(key)
+			if item != nil {
+				entries[key] = item.Data()
+			}
+		}
+		return nil
+	})
+
+	moved := 0
+	for key, data := range entries {
+		if dest.Add(key, data) != nil {
+			table.DeleteFromMemoryAndDisk(key)
+			moved++
+		}
+	}
+
+	return moved
+}
@@ -0,0 +1,57 @@
+package filecache
+
+import (
+	"fmt"
+	"testing"
+)
+
+type drainRecord struct {
+	Name  string
+	Count int
+}
+
+func TestDrainTo(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{
+			Name:           "json",
+			StartupOptions: noStartup,
+			SyncPersist:    true,
+			ToBytes:        ToJsonBytes,
+			FromBytes: JsonFromBytes(func() interface{} {
+				return &drainRecord{}
+			}),
+		},
+		CacheTableConfig{
+			Name:           "gob",
+			StartupOptions: noStartup,
+			SyncPersist:    true,
+			ToBytes:        ToGobBytes,
+			FromBytes:      GobFromBytes(drainRecord{}),
+		},
+	)
+	src, dest := tables[0], tables[1]
+
+	for i := 0; i < 10; i++ {
+		src.Add(fmt.Sprintf("k%d", i), &drainRecord{Name: fmt.Sprintf("n%d", i), Count: i})
+		// Leave half only on disk
+		if i%2 == 0 {
+			src.DeleteFromMemory(fmt.Sprintf("k%d", i))
+		}
+	}
+
+	if n := src.DrainTo(dest); n != 10 {
+		t.Errorf("moved %d, expected 10", n)
+	}
+	if n := src.Count() + src.DiskCount(); n != 0 {
+		t.Errorf("%d entries left in source", n)
+	}
+
+	dest.FlushMemory()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		expected := drainRecord{Name: fmt.Sprintf("n%d", i), Count: i}
+		if v := mustGet(t, dest, key); v != expected {
+			t.Errorf("%s = %#v, expected %#v", key, v, expected)
+		}
+	}
+}
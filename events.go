@@ -0,0 +1,94 @@
+package filecache
+
+import (
+	"sync"
+)
+
+// EventType identifies the type of an Event
+type EventType int
+
+const (
+	// EventAdd is published when an item is added to the table
+	EventAdd EventType = iota
+	// EventGet is published when Get returns an item
+	EventGet
+	// EventDelete is published when an item is removed from memory
+	EventDelete
+	// EventExpire is published when an entry is removed from disk by expiry, the disk quota or flushing
+	EventExpire
+)
+
+// Event is passed to listeners registered with Subscribe
+type Event struct {
+	Type EventType
+	Key  string
+	// The item concerned, nil for EventExpire
+	Item *CacheItem
+}
+
+// EventListener is a function which receives events from a table
+type EventListener func(Event)
+
+// eventListeners holds the listeners subscribed to a table
+type eventListeners struct {
+	mutex     sync.RWMutex
+	nextID    int
+	listeners map[EventType][]eventListener
+}
+
+type eventListener struct {
+	id int
+	f  EventListener
+}
+
+// Subscribe registers a listener for events of type t, returning a function which unsubscribes it.
+// Listeners are called in the order they subscribed & are never called with any lock held
+// so are free to call back into the table.
+func (table *CacheTable) Subscribe(t EventType, f EventListener) func() {
+	l := &table.listeners
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.listeners == nil {
+		l.listeners = make(map[EventType][]eventListener)
+	}
+
+	l.nextID++
+	id := l.nextID
+	l.listeners[t] = append(l.listeners[t], eventListener{id: id, f: f})
+
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		var ls []eventListener
+		for _, e := range l.listeners[t] {
+			if e.id != id {
+				ls = append(ls, e)
+			}
+		}
+		l.listeners[t] = ls
+	}
+}
+
+// hasListeners returns true if anything has subscribed to events of type t
+func (table *CacheTable) hasListeners(t EventType) bool {
+	l := &table.listeners
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.listeners[t]) > 0
+}
+
+// publish calls the listeners subscribed to events of type t.
+// Careful: do not run this method with the table-mutex locked!
+func (table *CacheTable) publish(t EventType, key string, item *CacheItem) {
+	l := &table.listeners
+	l.mutex.RLock()
+	ls := l.listeners[t]
+	l.mutex.RUnlock()
+
+	e := Event{Type: t, Key: key, Item: item}
+	for _, listener := range ls {
+		listener.f(e)
+	}
+}
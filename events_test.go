@@ -0,0 +1,109 @@
+package filecache
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	var mutex sync.Mutex
+	var events []string
+	record := func(name string) EventListener {
+		return func(e Event) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, fmt.Sprintf("%s:%d:%s", name, e.Type, e.Key))
+		}
+	}
+	recorded := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		s := strings.Join(events, ",")
+		events = nil
+		return s
+	}
+
+	table.Subscribe(EventAdd, record("first"))
+	unsubscribe := table.Subscribe(EventAdd, record("second"))
+	table.Subscribe(EventGet, record("get"))
+	table.Subscribe(EventDelete, record("delete"))
+	table.Subscribe(EventExpire, record("expire"))
+
+	table.Add("k", "v")
+	if e := recorded(); e != "first:0:k,second:0:k" {
+		t.Errorf("add published %q", e)
+	}
+
+	mustGet(t, table, "k")
+	if e := recorded(); e != "get:1:k" {
+		t.Errorf("get published %q", e)
+	}
+
+	table.DeleteFromMemory("k")
+	if e := recorded(); e != "delete:2:k" {
+		t.Errorf("delete published %q", e)
+	}
+
+	table.FlushDisk()
+	if e := recorded(); e != "expire:3:k" {
+		t.Errorf("flush published %q", e)
+	}
+
+	unsubscribe()
+	table.Add("k2", "v")
+	if e := recorded(); e != "first:0:k2" {
+		t.Errorf("after unsubscribe add published %q", e)
+	}
+
+	table.Add("k3", "v")
+	table.DeleteFromMemory("k3")
+	recorded()
+	if _, err := table.GetMulti([]string{"k2", "missing", "k3", "k2"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := recorded(); e != "first:0:k3,get:1:k2,get:1:k3" {
+		t.Errorf("GetMulti published %q", e)
+	}
+}
+
+func TestSubscribe_expiredOnDiskBeforeLoad(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DiskExpiryTime: time.Hour,
+		Clock:          clock,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			return NewCacheItem(key, 0, "loaded"), nil
+		},
+	})
+
+	table.Add("k", "v")
+	table.FlushMemory()
+	clock.Advance(2 * time.Hour)
+
+	var mutex sync.Mutex
+	var events []string
+	for _, t := range []EventType{EventAdd, EventGet, EventExpire} {
+		table.Subscribe(t, func(e Event) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, fmt.Sprintf("%d:%s", e.Type, e.Key))
+		})
+	}
+
+	if v := mustGet(t, table, "k"); v != "loaded" {
+		t.Errorf("got %v, expected loaded", v)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if e := strings.Join(events, ","); e != "3:k,0:k,1:k" {
+		t.Errorf("published %q, expected expire before add & get", e)
+	}
+}
@@ -0,0 +1,28 @@
+package filecache
+
+import (
+	"sort"
+)
+
+// evictLRU removes the least recently accessed items from memory, keeping them on disk,
+// until there are no more than maxMemoryItems in memory.
+func (table *CacheTable) evictLRU() {
+	// Careful: do not run this method unless the table-mutex is locked!
+	excess := len(table.items) - table.maxMemoryItems
+	if table.maxMemoryItems <= 0 || excess <= 0 {
+		return
+	}
+
+	items := make([]*CacheItem, 0, len(table.items))
+	for _, item := range table.items {
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].AccessedOn().Before(items[j].AccessedOn())
+	})
+
+	for _, item := range items[:excess] {
+		table.delete(item.key)
+	}
+}
@@ -0,0 +1,75 @@
+package filecache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxMemoryItems(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+
+	var mutex sync.Mutex
+	var deleted []string
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		MaxMemoryItems: 3,
+		Clock:          clock,
+		DeleteItem: func(item *CacheItem) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			deleted = append(deleted, item.Key())
+		},
+	})
+
+	for _, key := range []string{"a", "b", "c"} {
+		table.Add(key, key)
+		clock.Advance(time.Second)
+	}
+
+	// Accessing a makes b the least recently accessed
+	mustGet(t, table, "a")
+	clock.Advance(time.Second)
+
+	table.Add("d", "d")
+
+	mutex.Lock()
+	if len(deleted) != 1 || deleted[0] != "b" {
+		t.Errorf("DeleteItem called for %v, expected [b]", deleted)
+	}
+	mutex.Unlock()
+
+	if n := table.Count(); n != 3 {
+		t.Errorf("Count %d, expected 3", n)
+	}
+	for _, key := range table.KeysInMemory() {
+		if key == "b" {
+			t.Error("b still in memory")
+		}
+	}
+
+	// b is still on disk
+	item, source, err := table.GetWithSource("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != SourceDisk || item.Data() != "b" {
+		t.Errorf("got %v from %v", item.Data(), source)
+	}
+}
+
+func TestMaxMemoryItems_loadCache(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, MaxMemoryItems: 3})
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		table.Add(key, key)
+	}
+	table.FlushMemory()
+
+	table.loadCache(0)
+
+	if n := table.Count(); n != 3 {
+		t.Errorf("Count %d after loading, expected 3", n)
+	}
+}
@@ -1,7 +1,10 @@
 package filecache
 
 import (
+	"context"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,36 +14,47 @@ func (table *CacheTable) expireMemory() {
 
 	table.stopMemoryExpiryTimer()
 
-	now := time.Now()
-	smallestDuration := 0 * time.Second
+	now := table.now()
+
+	// The soonest time an item will expire, zero if no item expires
+	var next time.Time
 
 	for key, item := range table.items {
 		item.mutex.RLock()
 		lifeSpan := item.lifeSpan
-		accessedOn := item.accessedOn
+		expiresAt := item.expiresAt(table.expiryPolicy)
 		item.mutex.RUnlock()
 
+		// Items with a lifeSpan of 0 never expire so play no part in when the timer runs
 		if lifeSpan == 0 {
 			continue
 		}
 
-		if now.Sub(accessedOn) >= lifeSpan {
+		if !expiresAt.After(now) {
 			table.delete(key)
-		} else {
-			if smallestDuration == 0 || lifeSpan-now.Sub(accessedOn) < smallestDuration {
-				smallestDuration = lifeSpan - now.Sub(accessedOn)
-			}
+		} else if next.IsZero() || expiresAt.Before(next) {
+			next = expiresAt
 		}
 	}
 
-	table.cleanupInterval = smallestDuration
-	if smallestDuration > 0 {
-		table.cleanupTimer = time.AfterFunc(smallestDuration, func() {
-			go table.expireMemory()
-		})
+	table.cleanupAt = next
+
+	// Don't re-arm the timer once stopped, start runs this again to re-arm it
+	if next.IsZero() || !table.started.Load() {
+		return
+	}
+
+	// Reuse the one timer so there's only ever a single pending expiry.
+	// The timer runs its function in its own goroutine so it can call expireMemory directly
+	if table.cleanupTimer == nil {
+		table.cleanupTimer = time.AfterFunc(next.Sub(now), table.expireMemory)
+	} else {
+		table.cleanupTimer.Reset(next.Sub(now))
 	}
 }
 
+// stopMemoryExpiryTimer stops any pending memory expiry.
+// Careful: do not run this method unless the table-mutex is locked!
 func (table *CacheTable) stopMemoryExpiryTimer() {
 	if table.cleanupTimer != nil {
 		table.cleanupTimer.Stop()
@@ -51,33 +65,116 @@ func (table *CacheTable) stopMemoryExpiryTimer() {
 // and is not currently in memory.
 // This isn't exact as when the in memory copy is removed due lack of use then the disk copy
 // becomes available for expiry (i.e. deletion) even if it's only just expired.
+//
+// If MaxDiskBytes is set then the oldest entries will also be removed until the disk cache is within that limit.
+// Temporary files left behind by an interrupted write are removed once they are an hour old.
 func (table *CacheTable) ExpireDisk() int {
 	return table.ExpireDiskMaxAge(table.diskExpiryTime)
 }
 
+// ExpireDiskMaxAge removes any entry on disk who's modified time is older than maxAge.
+// Entries stored with a lifeSpan longer than maxAge are kept until that lifeSpan has passed.
 func (table *CacheTable) ExpireDiskMaxAge(maxAge time.Duration) int {
+	expired, _ := table.ExpireDiskContext(context.Background(), maxAge)
+	return expired
+}
+
+// ExpireDiskContext is the same as ExpireDiskMaxAge but stops early if ctx is cancelled or the table is stopped,
+// returning the number of entries expired so far along with the context's error.
+func (table *CacheTable) ExpireDiskContext(ctx context.Context, maxAge time.Duration) (int, error) {
+	expired, err := table.expireDisk(ctx, maxAge)
+	if err != nil {
+		return expired, err
+	}
+	return expired + table.parent.enforceTotalDiskQuota(), nil
+}
+
+// expireDisk is ExpireDiskContext without enforcing the cache's MaxTotalDiskBytes
+func (table *CacheTable) expireDisk(ctx context.Context, maxAge time.Duration) (int, error) {
 	table.stopDiskExpiryTimer()
 	defer table.startDiskExpiryTimer()
 
-	if maxAge > 0 {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if stopCtx := table.stopContext(); stopCtx != nil {
+		defer context.AfterFunc(stopCtx, cancel)()
+	}
+
+	if maxAge < 0 {
 		maxAge = -maxAge
 	}
-	expireTime := time.Now().Add(maxAge)
+	now := table.now()
 
-	expired := 0
+	var expired, found atomic.Int64
 
-	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+	// Temporary files left behind by a crash are never renamed into place so remove them once
+	// they are too old to still be being written
+	removeStaleTemp := func(path string, info os.FileInfo) {
+		if info.ModTime().Before(now.Add(-staleTempAge)) {
+			if err := table.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+				table.recordError(err)
+			}
+		}
+	}
+
+	err := table.walkParallelTemp(func(key, path string, info os.FileInfo, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		found.Add(1)
+
+		var lifeSpan time.Duration
+		if meta, err := table.readFileMeta(path); err == nil {
+			lifeSpan = meta.lifeSpan
+		}
+
+		if diskExpired(now, info.ModTime(), maxAge, lifeSpan) {
+			// An item in memory which has been accessed recently is still in use, even though
+			// its file is old, so refresh the file rather than expire it
+			if accessedOn, ok := table.accessedOn(key); ok && !diskExpired(now, accessedOn, maxAge, lifeSpan) {
+				_ = table.touchDisk(key, accessedOn)
+				return nil
+			}
 
-		if info.ModTime().Before(expireTime) {
 			// nre-feeds#21 remove from memory as well as disk
 			table.DeleteFromMemoryAndDisk(key)
-			expired++
+			table.diskEvicted(key)
+			expired.Add(1)
 		}
 
 		return nil
-	})
+	}, removeStaleTemp)
+	if err != nil {
+		return int(expired.Load()), err
+	}
 
-	return expired
+	quota := table.enforceDiskQuota()
+	table.lastDiskCount.Store(found.Load() - expired.Load() - int64(quota))
+
+	return int(expired.Load()) + quota, nil
+}
+
+// staleTempAge is how old a temporary file must be before ExpireDisk removes it
+const staleTempAge = time.Hour
+
+// accessedOn returns when key was last accessed if it is in memory
+func (table *CacheTable) accessedOn(key string) (time.Time, bool) {
+	table.mutex.RLock()
+	item, ok := table.items[key]
+	table.mutex.RUnlock()
+
+	if !ok {
+		return time.Time{}, false
+	}
+	return item.AccessedOn(), true
+}
+
+// diskExpired returns true if a file modified at modTime is older than maxAge, or lifeSpan if that is longer
+func diskExpired(now, modTime time.Time, maxAge, lifeSpan time.Duration) bool {
+	if lifeSpan > maxAge {
+		maxAge = lifeSpan
+	}
+	return modTime.Before(now.Add(-maxAge))
 }
 
 func (table *CacheTable) stopDiskExpiryTimer() {
@@ -93,6 +190,11 @@ func (table *CacheTable) startDiskExpiryTimer() {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
+	// Don't restart the timer once stopped, e.g. when an expiry is cancelled by stop
+	if table.memoryOnly || !table.started.Load() {
+		return
+	}
+
 	table.diskExpiryTimer = time.AfterFunc(table.diskExpiryInterval, func() {
 		go table.ExpireDisk()
 	})
@@ -101,13 +203,15 @@ func (table *CacheTable) startDiskExpiryTimer() {
 func (table *CacheTable) FlushMemoryAndDisk() {
 	table.stopDiskExpiryTimer()
 	table.mutex.Lock()
+	var evicted []string
 	defer func() {
 		table.mutex.Unlock()
 		table.startDiskExpiryTimer()
+		table.diskEvicted(evicted...)
 	}()
 
 	table.flushMemory()
-	table.flushDisk()
+	evicted = table.flushDisk()
 }
 
 func (table *CacheTable) FlushMemory() {
@@ -117,24 +221,86 @@ func (table *CacheTable) FlushMemory() {
 }
 
 func (table *CacheTable) flushMemory() {
+	for _, item := range table.items {
+		item.unsize()
+	}
 	table.items = make(map[string]*CacheItem)
-	table.cleanupInterval = 0
+	table.cleanupAt = time.Time{}
 	table.stopMemoryExpiryTimer()
 }
 
 func (table *CacheTable) FlushDisk() {
+	table.stopDiskExpiryTimer()
+	table.mutex.Lock()
+	var evicted []string
+	defer func() {
+		table.mutex.Unlock()
+		table.startDiskExpiryTimer()
+		table.diskEvicted(evicted...)
+	}()
+	evicted = table.flushDisk()
+}
+
+// Clear removes all entries from memory & disk.
+// Unlike FlushMemoryAndDisk this removes the table's directory in one go rather than removing each file,
+// which is far faster for a large cache, however the OnDiskEvict callback is not called.
+func (table *CacheTable) Clear() error {
+	// Ensure nothing queued gets written after we have cleared the disk
+	table.Sync()
+
 	table.stopDiskExpiryTimer()
 	table.mutex.Lock()
 	defer func() {
 		table.mutex.Unlock()
 		table.startDiskExpiryTimer()
 	}()
-	table.flushDisk()
+
+	table.flushMemory()
+	table.dropPending(func(string) bool {
+		return true
+	})
+
+	if table.memoryOnly {
+		return nil
+	}
+
+	err := table.fs.RemoveAll(table.basePath)
+	if err == nil {
+		table.indexClear()
+	}
+	if err == nil && !table.lazyDirCreate {
+		err = table.fs.MkdirAll(table.basePath, table.dirMode)
+	}
+	return err
 }
 
-func (table *CacheTable) flushDisk() {
-	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
-		_ = os.Remove(path)
+// flushDisk removes all entries from disk returning the keys removed
+func (table *CacheTable) flushDisk() []string {
+	var evicted []string
+	var mutex sync.Mutex
+	_ = table.walkParallel(func(key, path string, info os.FileInfo, err error) error {
+		err = table.fs.Remove(path)
+		if err != nil {
+			table.recordError(err)
+			return nil
+		}
+		table.indexRemove(key)
+
+		mutex.Lock()
+		evicted = append(evicted, key)
+		mutex.Unlock()
 		return nil
 	})
+	return evicted
+}
+
+// diskEvicted calls the onDiskEvict callback for each key removed from disk by expiry or flushing.
+// This must be called without the table-mutex being locked.
+func (table *CacheTable) diskEvicted(keys ...string) {
+	for _, key := range keys {
+		if table.onDiskEvict != nil {
+			table.onDiskEvict(key)
+		}
+		table.publish(EventExpire, key, nil)
+	}
 }
@@ -0,0 +1,493 @@
+package filecache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadDisk_expiredFileIsEvicted(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	evicted := make(chan string, 1)
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DiskExpiryTime: time.Hour,
+		Clock:          clock,
+		OnDiskEvict: func(key string) {
+			evicted <- key
+		},
+	})
+	expired := make(chan string, 1)
+	table.Subscribe(EventExpire, func(e Event) {
+		expired <- e.Key
+	})
+
+	table.Add("k", "v")
+	table.FlushMemory()
+	clock.Advance(2 * time.Hour)
+
+	if _, err := table.Get("k"); err != ErrKeyNotFound {
+		t.Fatalf("Get returned %v, expected ErrKeyNotFound", err)
+	}
+	if table.existsOnDisk("k") {
+		t.Error("expired file not removed")
+	}
+
+	for name, c := range map[string]chan string{"OnDiskEvict": evicted, "EventExpire": expired} {
+		select {
+		case key := <-c:
+			if key != "k" {
+				t.Errorf("%s called for %q", name, key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s not called", name)
+		}
+	}
+}
+
+func TestExpireMemory_zeroLifeSpanNeverExpires(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true, Clock: clock})
+
+	if table.Add("forever", "v") == nil {
+		t.Fatal("Add with an ExpiryTime of 0 failed")
+	}
+	table.AddExpiry("short", time.Second, "v")
+
+	clock.Advance(time.Hour)
+	table.expireMemory()
+
+	if !table.ExistsInMemory("forever") {
+		t.Error("item with a lifeSpan of 0 expired")
+	}
+	if table.ExistsInMemory("short") {
+		t.Error("item with a lifeSpan of 1s did not expire")
+	}
+}
+
+func TestDiskLifeSpan_preservedOnReload(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DiskExpiryTime: 30 * time.Minute,
+		Clock:          clock,
+	})
+
+	lifeSpans := map[string]time.Duration{"short": time.Hour, "long": 10 * time.Hour, "forever": 0}
+	createdOn := make(map[string]time.Time)
+	for key, lifeSpan := range lifeSpans {
+		createdOn[key] = table.AddExpiry(key, lifeSpan, key).CreatedOn()
+	}
+	table.FlushMemory()
+	clock.Advance(time.Minute)
+
+	for key, lifeSpan := range lifeSpans {
+		item, err := table.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.LifeSpan() != lifeSpan {
+			t.Errorf("%q lifeSpan %v, expected %v", key, item.LifeSpan(), lifeSpan)
+		}
+		if !item.CreatedOn().Equal(createdOn[key]) {
+			t.Errorf("%q createdOn %v, expected %v", key, item.CreatedOn(), createdOn[key])
+		}
+	}
+
+	// ExpireDisk keeps entries until their own lifeSpan has passed, or DiskExpiryTime if that is longer
+	table.FlushMemory()
+	clock.Advance(2 * time.Hour)
+	table.ExpireDisk()
+	for key, exists := range map[string]bool{"short": false, "long": true, "forever": false} {
+		if table.existsOnDisk(key) != exists {
+			t.Errorf("%q on disk %v, expected %v", key, !exists, exists)
+		}
+	}
+}
+
+func TestTouch_diskOnly(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	table.Add("k", "v")
+	table.FlushMemory()
+	old := time.Now().Add(-2 * time.Hour)
+	setModTime(t, table, "k", old)
+
+	if !table.Touch("k") {
+		t.Fatal("Touch returned false for a disk only key")
+	}
+	info, err := os.Stat(table.getFilePath("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(old) {
+		t.Errorf("modification time %v not advanced from %v", info.ModTime(), old)
+	}
+
+	table.ExpireDiskMaxAge(time.Hour)
+	if !table.existsOnDisk("k") {
+		t.Error("touched key expired")
+	}
+
+	if table.Touch("missing") {
+		t.Error("Touch returned true for a missing key")
+	}
+}
+
+func TestTouch_invalidKey(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup})
+
+	// A file outside of the table which a traversal key would resolve to
+	victim := filepath.Join(table.parent.cacheDir, "victim")
+	if err := os.WriteFile(victim, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(victim, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// The traversal only resolves once the key's directory exists
+	const key = "../../../victim"
+	dir, _ := table.getPath(key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if table.Touch(key) {
+		t.Error("Touch returned true for an invalid key")
+	}
+	info, err := os.Stat(victim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Errorf("file outside the table touched, modification time %v", info.ModTime())
+	}
+}
+
+func TestOnDiskEvict(t *testing.T) {
+	var mutex sync.Mutex
+	var evicted []string
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		OnDiskEvict: func(key string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			evicted = append(evicted, key)
+		},
+	})
+	evictedKeys := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sort.Strings(evicted)
+		keys := strings.Join(evicted, ",")
+		evicted = nil
+		return keys
+	}
+
+	for _, key := range []string{"old1", "old2", "new1", "new2"} {
+		table.Add(key, "v")
+	}
+	table.FlushMemory()
+	old := time.Now().Add(-2 * time.Hour)
+	setModTime(t, table, "old1", old)
+	setModTime(t, table, "old2", old)
+
+	table.ExpireDiskMaxAge(time.Hour)
+	if keys := evictedKeys(); keys != "old1,old2" {
+		t.Errorf("ExpireDiskMaxAge evicted %q", keys)
+	}
+
+	table.FlushDisk()
+	if keys := evictedKeys(); keys != "new1,new2" {
+		t.Errorf("FlushDisk evicted %q", keys)
+	}
+}
+
+func TestExpireMemory_timerFiresForSoonest(t *testing.T) {
+	start := time.Now()
+	clock := NewFakeClock(start)
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true, Clock: clock})
+
+	table.AddExpiry("forever1", 0, "v")
+	table.AddExpiry("long", time.Hour, "v")
+	table.AddExpiry("short", 50*time.Millisecond, "v")
+	table.AddExpiry("forever2", 0, "v")
+	table.expireMemory()
+
+	table.mutex.RLock()
+	cleanupAt := table.cleanupAt
+	table.mutex.RUnlock()
+	if expected := start.Add(50 * time.Millisecond); !cleanupAt.Equal(expected) {
+		t.Errorf("timer scheduled for %v, expected %v", cleanupAt, expected)
+	}
+
+	// Let the timer fire without calling expireMemory ourselves
+	clock.Advance(time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for table.ExistsInMemory("short") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if table.ExistsInMemory("short") {
+		t.Fatal("short item did not expire")
+	}
+	for _, key := range []string{"forever1", "forever2", "long"} {
+		if !table.ExistsInMemory(key) {
+			t.Errorf("%q expired", key)
+		}
+	}
+
+	table.mutex.RLock()
+	cleanupAt = table.cleanupAt
+	table.mutex.RUnlock()
+	if expected := start.Add(time.Hour); !cleanupAt.Equal(expected) {
+		t.Errorf("timer rescheduled for %v, expected %v", cleanupAt, expected)
+	}
+}
+
+func TestExpireMemory_goroutinesBounded(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true})
+
+	before := runtime.NumGoroutine()
+	peak := before
+	for i := 0; i < 5000; i++ {
+		table.AddExpiry(fmt.Sprintf("k%d", i%100), time.Duration(1+i%5)*time.Millisecond, "v")
+		if n := runtime.NumGoroutine(); n > peak {
+			peak = n
+		}
+	}
+
+	if peak > before+10 {
+		t.Errorf("goroutines grew from %d to %d", before, peak)
+	}
+}
+
+// cancelFS cancels a context once a number of files have been opened
+type cancelFS struct {
+	OSFilesystem
+	opens  atomic.Int64
+	after  int64
+	cancel context.CancelFunc
+}
+
+func (fs *cancelFS) Open(name string) (File, error) {
+	if fs.opens.Add(1) == fs.after {
+		fs.cancel()
+	}
+	return fs.OSFilesystem.Open(name)
+}
+
+func TestExpireDiskContext_cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fs := &cancelFS{after: 10, cancel: cancel}
+	table := newTestTables(t, CacheConfig{Filesystem: fs}, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+	})[0]
+
+	old := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k%d", i)
+		table.Add(key, "v")
+		setModTime(t, table, key, old)
+	}
+	table.FlushMemory()
+	fs.opens.Store(0)
+
+	expired, err := table.ExpireDiskContext(ctx, time.Hour)
+	if err != context.Canceled {
+		t.Errorf("ExpireDiskContext returned %v, expected %v", err, context.Canceled)
+	}
+	if opens := fs.opens.Load(); opens > 20 {
+		t.Errorf("%d files opened after cancellation", opens)
+	}
+
+	remaining := table.DiskCount()
+	if remaining == 0 {
+		t.Error("walk was not stopped")
+	}
+	if expired != 200-remaining {
+		t.Errorf("expired %d, but %d removed", expired, 200-remaining)
+	}
+}
+
+func TestClear(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	for i := 0; i < 200; i++ {
+		table.Add(fmt.Sprintf("k%d", i), "v")
+	}
+	table.FlushMemory()
+	table.Add("mem", "v")
+
+	if err := table.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if n := table.Count(); n != 0 {
+		t.Errorf("Count %d after Clear, expected 0", n)
+	}
+	if n := table.DiskCount(); n != 0 {
+		t.Errorf("DiskCount %d after Clear, expected 0", n)
+	}
+	if _, err := table.Get("k0"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v after Clear, expected %v", err, ErrKeyNotFound)
+	}
+
+	table.Add("k0", "again")
+	table.FlushMemory()
+	if v := mustGet(t, table, "k0"); v != "again" {
+		t.Errorf("got %v, expected again", v)
+	}
+}
+
+func TestExpireDisk_accessedItemKeepsFile(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, Clock: clock})
+
+	table.AddExpiry("hot", 0, "v")
+	table.AddExpiry("cold", 0, "v")
+	setModTime(t, table, "hot", start)
+	setModTime(t, table, "cold", start)
+
+	for i := 0; i < 4; i++ {
+		clock.Advance(30 * time.Minute)
+		if v := mustGet(t, table, "hot"); v != "v" {
+			t.Fatalf("got %v", v)
+		}
+	}
+
+	table.ExpireDiskMaxAge(time.Hour)
+	if !table.existsOnDisk("hot") {
+		t.Error("file of an item in use was expired")
+	}
+	if table.existsOnDisk("cold") {
+		t.Error("file of an unused item was not expired")
+	}
+
+	info, err := os.Stat(table.getFilePath("hot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(clock.Now()) {
+		t.Errorf("modification time %v, expected the last access %v", info.ModTime(), clock.Now())
+	}
+}
+
+func TestExpireMemory_notRearmedWhenStopped(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true})
+	cache := table.parent
+
+	table.AddExpiry("k", 50*time.Millisecond, "v")
+	cache.Stop()
+
+	// An expiry pass whilst stopped, e.g. from Warm, leaves the timer stopped
+	table.expireMemory()
+	time.Sleep(100 * time.Millisecond)
+	if !table.ExistsInMemory("k") {
+		t.Fatal("memory expiry timer ran whilst the table was stopped")
+	}
+
+	// Restarting re-arms it
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for table.ExistsInMemory("k") {
+		if time.Now().After(deadline) {
+			t.Fatal("memory expiry timer not re-armed on start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExpireMemory_fakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, Clock: clock})
+
+	table.AddExpiry("k", 10*time.Second, "v")
+
+	clock.Advance(10*time.Second - time.Nanosecond)
+	table.expireMemory()
+	if !table.ExistsInMemory("k") {
+		t.Fatal("expired before its lifeSpan")
+	}
+
+	clock.Advance(time.Nanosecond)
+	table.expireMemory()
+	if table.ExistsInMemory("k") {
+		t.Error("not expired once its lifeSpan had passed")
+	}
+}
+
+func TestLoadEntireCache_keepsExpiredFiles(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, DiskExpiryTime: time.Hour})
+
+	table.Add("old", "v")
+	table.Add("new", "v")
+	table.FlushMemory()
+	setModTime(t, table, "old", time.Now().Add(-2*time.Hour))
+
+	// As used by LoadEntireCacheOnStart
+	table.loadCache(0)
+
+	for _, key := range []string{"old", "new"} {
+		if !table.ExistsInMemory(key) {
+			t.Errorf("%q not loaded", key)
+		}
+		if !table.existsOnDisk(key) {
+			t.Errorf("%q removed from disk", key)
+		}
+	}
+}
+
+func TestGet_expiredFileIsMiss(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, DiskExpiryTime: time.Hour})
+
+	table.Add("old", "v")
+	table.Add("new", "v")
+	table.FlushMemory()
+	setModTime(t, table, "old", time.Now().Add(-2*time.Hour))
+
+	if _, err := table.Get("old"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v, expected %v", err, ErrKeyNotFound)
+	}
+	if table.existsOnDisk("old") {
+		t.Error("expired file not removed")
+	}
+	if v := mustGet(t, table, "new"); v != "v" {
+		t.Errorf("got %v, expected v", v)
+	}
+}
+
+func TestForeachDiskData_keepsExpiredFileOfMemoryItem(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DiskExpiryTime: time.Hour,
+		Clock:          clock,
+	})
+
+	table.Add("k", "v")
+	clock.Advance(2 * time.Hour)
+
+	table.ForeachDiskData(func(key string, item *CacheItem) {
+		t.Errorf("expired %q walked", key)
+	})
+	if !table.existsOnDisk("k") {
+		t.Error("file backing an item in memory removed")
+	}
+}
@@ -0,0 +1,108 @@
+package filecache
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Export writes all entries on disk to w as a tar archive.
+// Each entry is named after its key and keeps the modification time of the file on disk.
+// Entries are exported as stored so compression & encryption are preserved, which means
+// the table they are imported into must have a compatible configuration.
+func (table *CacheTable) Export(w io.Writer) error {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	tw := tar.NewWriter(w)
+
+	err := table.walk(func(key, path string, info os.FileInfo, err error) error {
+		b, err := table.readFile(path)
+		if err == nil {
+			b, err = table.decodeFile(key, b)
+		}
+		if err != nil {
+			table.recordError(err)
+			return nil
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     key,
+			Size:     int64(len(b)),
+			Mode:     int64(table.fileMode),
+			ModTime:  info.ModTime(),
+		})
+		if err == nil {
+			_, err = tw.Write(b)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Import restores entries from a tar archive created by Export.
+// Existing entries with the same key are replaced & removed from memory so the imported value is
+// read from disk on the next Get.
+func (table *CacheTable) Import(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Skip anything that isn't a valid key so a malicious archive can't write outside the table
+		if hdr.Typeflag != tar.TypeReg || !validKey(hdr.Name) {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		// Entries exported from files written before metadata was stored are given it, as every file with
+		// a key header must have metadata
+		if !bytes.HasPrefix(b, metaMagic) {
+			b = encodeMeta(fileMeta{lifeSpan: table.expiryTime, createdOn: hdr.ModTime}, b)
+		}
+
+		key := hdr.Name
+		dir, fileName := table.getPath(key)
+		path := dir + PathSeparator + fileName
+
+		err = table.fs.MkdirAll(dir, table.dirMode)
+		if err == nil {
+			err = table.fs.WriteFile(path, table.encodeFile(key, b), table.fileMode)
+		}
+		if err == nil {
+			err = table.fs.Chtimes(path, hdr.ModTime, hdr.ModTime)
+		}
+		if err != nil {
+			return err
+		}
+
+		table.indexAdd(key)
+		table.DeleteFromMemory(key)
+	}
+}
+
+// readFile reads the entire content of a file
+func (table *CacheTable) readFile(path string) ([]byte, error) {
+	f, err := table.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
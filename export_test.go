@@ -0,0 +1,52 @@
+package filecache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{Name: "source", StartupOptions: noStartup, SyncPersist: true, HashFilenames: true},
+		CacheTableConfig{Name: "dest", StartupOptions: noStartup, SyncPersist: true, HashFilenames: true},
+	)
+	source, dest := tables[0], tables[1]
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		source.Add(key, "value "+key)
+		setModTime(t, source, key, modTime)
+	}
+
+	var buf bytes.Buffer
+	if err := source.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	source.FlushMemoryAndDisk()
+
+	if err := dest.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := dest.DiskCount(); n != 20 {
+		t.Errorf("imported %d entries, expected 20", n)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+
+		info, err := os.Stat(dest.getFilePath(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%q modification time %v, expected %v", key, info.ModTime(), modTime)
+		}
+
+		if v := mustGet(t, dest, key); v != "value "+key {
+			t.Errorf("%q got %v", key, v)
+		}
+	}
+}
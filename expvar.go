@@ -0,0 +1,29 @@
+package filecache
+
+import (
+	"expvar"
+)
+
+// PublishExpvar publishes statistics for every table in this cache via expvar under name,
+// making them available at /debug/vars.
+// As with expvar.Publish this panics if name has already been published.
+func (c *Cache) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		vars := make(map[string]interface{})
+		for _, t := range c.Tables() {
+			stats := t.Stats()
+			vars[t.Name()] = map[string]interface{}{
+				"items":       t.Count(),
+				"diskEntries": t.DiskCountEstimate(),
+				"memoryHits":  stats.MemoryHits,
+				"diskHits":    stats.DiskHits,
+				"loads":       stats.Loads,
+				"misses":      stats.Misses,
+				"dropped":     stats.Dropped,
+				"size":        stats.Size,
+				"queueLength": t.QueueLength(),
+			}
+		}
+		return vars
+	}))
+}
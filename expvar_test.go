@@ -0,0 +1,53 @@
+package filecache
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// expvarRuns makes the published name unique as expvar names cannot be reused, e.g. with -count
+var expvarRuns atomic.Int32
+
+func TestPublishExpvar(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+	name := fmt.Sprintf("filecache_test_%d", expvarRuns.Add(1))
+	table.parent.PublishExpvar(name)
+
+	table.Add("a", "v")
+	table.Add("b", "v")
+	table.DeleteFromMemory("b")
+	mustGet(t, table, "a")
+	mustGet(t, table, "b")
+	_, _ = table.Get("missing")
+	// diskEntries is the count from the last walk of the disk
+	table.DiskCount()
+
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatal("not published")
+	}
+
+	var vars map[string]map[string]int64
+	if err := json.Unmarshal([]byte(v.String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int64{
+		"items":       2,
+		"diskEntries": 2,
+		"memoryHits":  1,
+		"diskHits":    1,
+		"loads":       0,
+		"misses":      1,
+		"dropped":     0,
+		"queueLength": 0,
+	}
+	for name, value := range expected {
+		if got := vars["test"][name]; got != value {
+			t.Errorf("%s = %d, expected %d", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package filecache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File is a file opened for reading from a Filesystem
+type File interface {
+	io.ReadCloser
+	Stat() (os.FileInfo, error)
+}
+
+// Filesystem abstracts the storage used to persist the cache.
+// The default is OSFilesystem but this allows alternatives such as an in-memory filesystem for tests.
+// Errors for files which do not exist must satisfy os.IsNotExist.
+type Filesystem interface {
+	// Open opens a file for reading
+	Open(name string) (File, error)
+	// WriteFile writes a file. This must be atomic, readers must only ever see either the old or new
+	// complete file
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// Remove removes a file
+	Remove(name string) error
+	// RemoveAll removes a path and any children it contains
+	RemoveAll(path string) error
+	// Stat returns the os.FileInfo of a file
+	Stat(name string) (os.FileInfo, error)
+	// Chtimes changes the access and modification times of a file
+	Chtimes(name string, atime, mtime time.Time) error
+	// Walk walks the file tree rooted at root in the same manner as filepath.Walk
+	Walk(root string, fn filepath.WalkFunc) error
+	// MkdirAll creates a directory along with any necessary parents
+	MkdirAll(path string, perm os.FileMode) error
+}
+
+// StreamFilesystem is an optional interface implemented by a Filesystem which can write a file
+// from an io.Reader without holding the entire content in memory.
+// Filesystems which don't implement it have the content read into memory & passed to WriteFile.
+type StreamFilesystem interface {
+	// WriteStream writes a file with the content of r. As with WriteFile this must be atomic
+	WriteStream(name string, r io.Reader, perm os.FileMode) error
+}
+
+// OSFilesystem is the default Filesystem which uses the os package
+type OSFilesystem struct{}
+
+func (OSFilesystem) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+// WriteFile writes a file by writing to a temporary file in the same directory then
+// renaming it into place so readers only ever see either the old or new complete file.
+func (fs OSFilesystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return fs.WriteStream(name, bytes.NewReader(data), perm)
+}
+
+// WriteStream is the same as WriteFile but copies the content from r
+func (OSFilesystem) WriteStream(name string, r io.Reader, perm os.FileMode) error {
+	// The temporary name is short & fixed length so it's valid whenever name is, and starts with "."
+	// so walk ignores it
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, name)
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+	}
+	return err
+}
+
+func (OSFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFilesystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFilesystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFilesystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (OSFilesystem) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+func (OSFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
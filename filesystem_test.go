@@ -0,0 +1,314 @@
+package filecache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWriteFile_readersNeverSeePartialFiles(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	values := []string{"short", strings.Repeat("long", 64*1024)}
+	table.Add("k", values[0])
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			table.Add("k", values[i%2])
+		}
+		close(stop)
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				item, _ := table.readDisk("k", false)
+				if item == nil {
+					t.Error("reader failed to decode file")
+					return
+				}
+				if v := item.Data(); v != values[0] && v != values[1] {
+					t.Errorf("reader got a value of length %d", len(v.(string)))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := table.LastError(); err != nil {
+		t.Errorf("LastError %v", err)
+	}
+
+	// No temporary files should be left behind
+	entries, err := os.ReadDir(filepath.Dir(table.getFilePath("k")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("found %d files, expected 1", len(entries))
+	}
+}
+
+// memFS is an in-memory Filesystem
+type memFS struct {
+	mutex sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	dir     bool
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memFile{
+		"/": {name: "/", mode: os.ModeDir | 0755, dir: true},
+	}}
+}
+
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) Mode() os.FileMode  { return f.mode }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return f.dir }
+func (f *memFile) Sys() interface{}   { return nil }
+
+// memOpenFile is a memFile opened for reading
+type memOpenFile struct {
+	*bytes.Reader
+	info memFile
+}
+
+func (f *memOpenFile) Close() error               { return nil }
+func (f *memOpenFile) Stat() (os.FileInfo, error) { return &f.info, nil }
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memFS) Open(name string) (File, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	f, ok := fs.files[filepath.Clean(name)]
+	if !ok || f.dir {
+		return nil, notExist("open", name)
+	}
+	return &memOpenFile{Reader: bytes.NewReader(f.data), info: *f}, nil
+}
+
+func (fs *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	name = filepath.Clean(name)
+	if parent, ok := fs.files[filepath.Dir(name)]; !ok || !parent.dir {
+		return notExist("open", name)
+	}
+	fs.files[name] = &memFile{
+		name:    filepath.Base(name),
+		data:    append([]byte(nil), data...),
+		mode:    perm,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := fs.files[name]; !ok {
+		return notExist("remove", name)
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *memFS) RemoveAll(path string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	path = filepath.Clean(path)
+	for name := range fs.files {
+		if name == path || strings.HasPrefix(name, path+"/") {
+			delete(fs.files, name)
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	f, ok := fs.files[filepath.Clean(name)]
+	if !ok {
+		return nil, notExist("stat", name)
+	}
+	info := *f
+	return &info, nil
+}
+
+func (fs *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	f, ok := fs.files[filepath.Clean(name)]
+	if !ok {
+		return notExist("chtimes", name)
+	}
+	f.modTime = mtime
+	return nil
+}
+
+func (fs *memFS) Walk(root string, fn filepath.WalkFunc) error {
+	root = filepath.Clean(root)
+
+	// Take a snapshot so fn can modify the filesystem
+	fs.mutex.Lock()
+	var names []string
+	infos := make(map[string]os.FileInfo)
+	for name, f := range fs.files {
+		if name == root || strings.HasPrefix(name, root+"/") {
+			info := *f
+			names = append(names, name)
+			infos[name] = &info
+		}
+	}
+	fs.mutex.Unlock()
+
+	if _, ok := infos[root]; !ok {
+		return fn(root, nil, notExist("lstat", root))
+	}
+
+	sort.Strings(names)
+	var skip string
+	for _, name := range names {
+		if skip != "" && strings.HasPrefix(name, skip+"/") {
+			continue
+		}
+		err := fn(name, infos[name], nil)
+		if err == filepath.SkipDir && infos[name].IsDir() {
+			skip = name
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for path = filepath.Clean(path); path != "/" && path != "."; path = filepath.Dir(path) {
+		if f, ok := fs.files[path]; ok {
+			if !f.dir {
+				return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		fs.files[path] = &memFile{name: filepath.Base(path), mode: os.ModeDir | perm, modTime: time.Now(), dir: true}
+	}
+	return nil
+}
+
+func TestWriteFile_longKey(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	// The longest filename most filesystems allow
+	key := strings.Repeat("k", 255)
+	if _, err := table.AddErr(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	table.FlushMemory()
+	if v := mustGet(t, table, key); v != "v" {
+		t.Errorf("got %v", v)
+	}
+}
+
+func TestExpireDisk_removesStaleTempFiles(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	table.Add("k", "v")
+	dir, _ := table.getPath("k")
+	stale := filepath.Join(dir, ".tmp123")
+	fresh := filepath.Join(dir, ".tmp456")
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	table.ExpireDisk()
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale temporary file not removed: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("temporary file which may still be being written removed: %v", err)
+	}
+	if !table.existsOnDisk("k") {
+		t.Error("entry removed")
+	}
+}
+
+func TestFilesystem_inMemory(t *testing.T) {
+	fs := newMemFS()
+	table := newTestTables(t, CacheConfig{CacheDir: "/cache", Filesystem: fs}, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+	})[0]
+
+	for _, key := range []string{"a", "b", "c"} {
+		table.Add(key, "value "+key)
+	}
+	if _, err := os.Stat("/cache"); !os.IsNotExist(err) {
+		t.Fatalf("cache written to the real filesystem: %v", err)
+	}
+	if _, err := fs.Stat(table.getFilePath("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	table.FlushMemory()
+	if n := table.DiskCount(); n != 3 {
+		t.Errorf("DiskCount %d, expected 3", n)
+	}
+	if v := mustGet(t, table, "b"); v != "value b" {
+		t.Errorf("got %v", v)
+	}
+
+	table.FlushMemory()
+	old := time.Now().Add(-2 * time.Hour)
+	if err := fs.Chtimes(table.getFilePath("a"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if n := table.ExpireDiskMaxAge(time.Hour); n != 1 {
+		t.Errorf("ExpireDiskMaxAge expired %d, expected 1", n)
+	}
+
+	table.DeleteFromMemoryAndDisk("b")
+	if keys := table.Keys(); len(keys) != 1 || keys[0] != "c" {
+		t.Errorf("Keys returned %v", keys)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/peter-mount/filecache
+
+go 1.21
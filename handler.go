@@ -0,0 +1,105 @@
+package filecache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Handler returns an http.Handler exposing the cache as a REST API:
+//
+//	GET    /{table}        returns a JSON array of the keys in the table
+//	GET    /{table}/{key}  returns the value of key
+//	PUT    /{table}/{key}  sets the value of key to the request body
+//	DELETE /{table}/{key}  deletes key from memory & disk
+//
+// Values are encoded with the table's ToBytes & decoded with its FromBytes.
+// Values stored with AddBytes, or PUT to a table without a FromBytes, are handled as raw bytes.
+func (c *Cache) Handler() http.Handler {
+	return http.HandlerFunc(c.serveHTTP)
+}
+
+func (c *Cache) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+
+	table := c.GetCache(path[0])
+	if table == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(path) == 1 {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(table.Keys())
+		return
+	}
+
+	// The key is used to build the path on disk so anything which isn't a valid key, including one
+	// containing a "/" which is only possible once unescaped, is rejected before the table sees it
+	key := path[1]
+	if strings.Contains(key, "/") || !validKey(key) {
+		http.Error(w, ErrInvalidKey.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		table.serveGet(w, r, key)
+	case http.MethodPut:
+		table.servePut(w, r, key)
+	case http.MethodDelete:
+		table.DeleteFromMemoryAndDisk(key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPut, http.MethodDelete}, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (table *CacheTable) serveGet(w http.ResponseWriter, r *http.Request, key string) {
+	item, err := table.Get(key)
+	if err == ErrKeyNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := table.encode(item)
+	if err != nil {
+		http.Error(w, ErrEncode.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, _ = w.Write(b)
+}
+
+func (table *CacheTable) servePut(w http.ResponseWriter, r *http.Request, key string) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var item *CacheItem
+	if table.fromBytes == nil {
+		item = table.AddBytes(key, table.expiryTime, b)
+	} else if data, _ := safeFromBytes(table.fromBytes, b); data != nil {
+		item = table.Add(key, data)
+	}
+
+	if item == nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,83 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup})
+	server := httptest.NewServer(table.parent.Handler())
+	defer server.Close()
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	// A file outside of the cache which a traversal key would resolve to once its directory exists
+	const traversal = "..%2F..%2F..%2F..%2Fvictim"
+	victim := filepath.Join(filepath.Dir(table.parent.cacheDir), "victim")
+	if err := os.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := table.getPath("../../../../victim")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		response           string
+	}{
+		{http.MethodPut, "/test/k", "value", http.StatusNoContent, ""},
+		{http.MethodGet, "/test/k", "", http.StatusOK, "value"},
+		{http.MethodGet, "/test", "", http.StatusOK, "[\"k\"]\n"},
+		{http.MethodDelete, "/test/k", "", http.StatusNoContent, ""},
+		{http.MethodGet, "/test/k", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/test", "", http.StatusOK, "[]\n"},
+		{http.MethodGet, "/missing", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/missing/k", "", http.StatusNotFound, ""},
+		{http.MethodPost, "/test", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/test/k", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodPut, "/test/.invalid", "value", http.StatusBadRequest, ""},
+		{http.MethodGet, "/test/.invalid", "", http.StatusBadRequest, ""},
+		{http.MethodDelete, "/test/.invalid", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/test/a/b", "", http.StatusBadRequest, ""},
+		{http.MethodGet, "/test/" + traversal, "", http.StatusBadRequest, ""},
+		{http.MethodPut, "/test/" + traversal, "pwned", http.StatusBadRequest, ""},
+		{http.MethodDelete, "/test/" + traversal, "", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		status, response := do(test.method, test.path, test.body)
+		if status != test.status {
+			t.Errorf("%s %s returned %d, expected %d", test.method, test.path, status, test.status)
+		}
+		if test.response != "" && response != test.response {
+			t.Errorf("%s %s returned %q, expected %q", test.method, test.path, response, test.response)
+		}
+	}
+
+	if b, err := os.ReadFile(victim); err != nil || string(b) != "original" {
+		t.Errorf("file outside the cache is now %q %v", b, err)
+	}
+}
@@ -0,0 +1,112 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// noStartup is a StartupOptions value which does nothing when the table starts, so tests are not
+// racing the default FlushCacheOnStart
+const noStartup = -1
+
+func stringToBytes(v interface{}) []byte {
+	return []byte(v.(string))
+}
+
+func stringFromBytes(b []byte) interface{} {
+	return string(b)
+}
+
+// newTestTable returns a started table in a temporary directory which is stopped when the test ends.
+// If cfg has no ToBytes or FromBytes then values are strings.
+func newTestTable(t testing.TB, cfg CacheTableConfig) *CacheTable {
+	t.Helper()
+	return newTestTables(t, CacheConfig{}, cfg)[0]
+}
+
+// newTestTables returns a started Cache with the supplied tables, stopped when the test ends.
+// If cacheCfg has no CacheDir then a temporary directory is used.
+func newTestTables(t testing.TB, cacheCfg CacheConfig, cfgs ...CacheTableConfig) []*CacheTable {
+	t.Helper()
+
+	if cacheCfg.CacheDir == "" {
+		cacheCfg.CacheDir = t.TempDir()
+	}
+	cache := NewCache(cacheCfg)
+
+	var tables []*CacheTable
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			cfg.Name = "test"
+		}
+		if cfg.ToBytes == nil && cfg.FromBytes == nil {
+			cfg.ToBytes, cfg.FromBytes = stringToBytes, stringFromBytes
+		}
+
+		table, err := cache.AddCache(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cache.Stop)
+
+	return tables
+}
+
+// mustGet returns the value of key failing the test if it cannot be found
+func mustGet(t testing.TB, table *CacheTable, key string) interface{} {
+	t.Helper()
+	item, err := table.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	return item.Data()
+}
+
+// setModTime sets the modification time of key's file on disk
+func setModTime(t testing.TB, table *CacheTable, key string, modTime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(table.getFilePath(key), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testFS is an OSFilesystem which counts writes, stats & walks. If gate is set then writes block until it
+// is closed and if writeErr is set then writes fail with it.
+type testFS struct {
+	OSFilesystem
+	writes   atomic.Int64
+	stats    atomic.Int64
+	walks    atomic.Int64
+	gate     chan struct{}
+	writeErr atomic.Value
+}
+
+func (fs *testFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fs.writes.Add(1)
+	if fs.gate != nil {
+		<-fs.gate
+	}
+	if err, ok := fs.writeErr.Load().(error); ok {
+		return err
+	}
+	return fs.OSFilesystem.WriteFile(name, data, perm)
+}
+
+func (fs *testFS) Stat(name string) (os.FileInfo, error) {
+	fs.stats.Add(1)
+	return fs.OSFilesystem.Stat(name)
+}
+
+func (fs *testFS) Walk(root string, fn filepath.WalkFunc) error {
+	fs.walks.Add(1)
+	return fs.OSFilesystem.Walk(root, fn)
+}
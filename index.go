@@ -0,0 +1,96 @@
+package filecache
+
+import (
+	"os"
+	"sync"
+)
+
+// diskIndex is an in-memory set of the keys on disk so Exists doesn't need to check the disk
+type diskIndex struct {
+	mutex    sync.RWMutex
+	keys     map[string]struct{}
+	complete bool
+}
+
+// buildDiskIndex walks the disk adding every key to the index.
+// Until this completes lookups fall back to checking the disk.
+func (table *CacheTable) buildDiskIndex() {
+	if !table.indexDisk || table.memoryOnly {
+		return
+	}
+
+	idx := &table.diskIndex
+	idx.mutex.Lock()
+	idx.keys = make(map[string]struct{})
+	idx.complete = false
+	idx.mutex.Unlock()
+
+	err := table.walk(func(key, path string, info os.FileInfo, err error) error {
+		table.indexAdd(key)
+		return nil
+	})
+
+	// If the walk failed the index is left incomplete so lookups keep checking the disk
+	if err == nil {
+		idx.mutex.Lock()
+		idx.complete = true
+		idx.mutex.Unlock()
+	}
+}
+
+// indexLookup returns whether key is on disk according to the index.
+// ok is false if the index is disabled or not yet complete.
+func (table *CacheTable) indexLookup(key string) (exists, ok bool) {
+	idx := &table.diskIndex
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	if !idx.complete {
+		return false, false
+	}
+	_, exists = idx.keys[key]
+	return exists, true
+}
+
+// indexCount returns how many keys are on disk according to the index.
+// ok is false if the index is disabled or not yet complete.
+func (table *CacheTable) indexCount() (count int, ok bool) {
+	idx := &table.diskIndex
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	if !idx.complete {
+		return 0, false
+	}
+	return len(idx.keys), true
+}
+
+// indexAdd records a key as being on disk
+func (table *CacheTable) indexAdd(key string) {
+	idx := &table.diskIndex
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if idx.keys != nil {
+		idx.keys[key] = struct{}{}
+	}
+}
+
+// indexRemove records a key as no longer being on disk
+func (table *CacheTable) indexRemove(key string) {
+	idx := &table.diskIndex
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	delete(idx.keys, key)
+}
+
+// indexClear records the disk as being empty
+func (table *CacheTable) indexClear() {
+	idx := &table.diskIndex
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if idx.keys != nil {
+		idx.keys = make(map[string]struct{})
+	}
+}
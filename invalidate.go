@@ -0,0 +1,52 @@
+package filecache
+
+// Invalidate removes an item from memory, keeping it on disk, and marks it so the next Get calls the
+// DataLoader rather than reading the disk copy.
+// If the DataLoader returns an error then the disk copy is returned instead, without being added to memory.
+// The mark is cleared once the key is added again, either by the DataLoader or by Add, or deleted from disk.
+// If the table has no DataLoader then this is the same as DeleteFromMemory.
+func (table *CacheTable) Invalidate(key string) {
+	if !validKey(key) {
+		return
+	}
+
+	table.DeleteFromMemory(key)
+
+	if table.dataLoader == nil {
+		return
+	}
+
+	table.clearTombstone(key)
+
+	table.invalidatedMutex.Lock()
+	defer table.invalidatedMutex.Unlock()
+	if table.invalidated == nil {
+		table.invalidated = make(map[string]bool)
+	}
+	table.invalidated[key] = true
+}
+
+// isInvalidated returns true if the key has been invalidated since it was last added
+func (table *CacheTable) isInvalidated(key string) bool {
+	table.invalidatedMutex.Lock()
+	defer table.invalidatedMutex.Unlock()
+	return table.invalidated[key]
+}
+
+// clearInvalidated removes the invalidated mark for a key as it has been added or deleted
+func (table *CacheTable) clearInvalidated(key string) {
+	table.invalidatedMutex.Lock()
+	defer table.invalidatedMutex.Unlock()
+	delete(table.invalidated, key)
+}
+
+// clearInvalidatedMatching removes the invalidated mark for every key which matches
+func (table *CacheTable) clearInvalidatedMatching(match func(key string) bool) {
+	table.invalidatedMutex.Lock()
+	defer table.invalidatedMutex.Unlock()
+	for key := range table.invalidated {
+		if match(key) {
+			delete(table.invalidated, key)
+		}
+	}
+}
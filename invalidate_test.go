@@ -0,0 +1,88 @@
+package filecache
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInvalidate(t *testing.T) {
+	var calls atomic.Int32
+	var fail atomic.Bool
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			calls.Add(1)
+			if fail.Load() {
+				return nil, errors.New("backend down")
+			}
+			return NewCacheItem(key, 0, "loaded"), nil
+		},
+	})
+
+	table.Add("k", "stale")
+	table.Invalidate("k")
+	if table.ExistsInMemory("k") {
+		t.Error("Invalidate left the item in memory")
+	}
+	if !table.existsOnDisk("k") {
+		t.Fatal("Invalidate removed the disk copy")
+	}
+
+	if v := mustGet(t, table, "k"); v != "loaded" {
+		t.Errorf("got %v after Invalidate, expected loaded", v)
+	}
+	if c := calls.Load(); c != 1 {
+		t.Errorf("DataLoader called %d times, expected 1", c)
+	}
+
+	// Once reloaded the key is no longer invalidated
+	table.FlushMemory()
+	if v := mustGet(t, table, "k"); v != "loaded" {
+		t.Errorf("got %v, expected loaded", v)
+	}
+	if c := calls.Load(); c != 1 {
+		t.Errorf("DataLoader called %d times after reading from disk, expected 1", c)
+	}
+
+	// The disk copy is the fallback if the DataLoader fails
+	table.Add("k", "disk")
+	table.Invalidate("k")
+	fail.Store(true)
+	if v := mustGet(t, table, "k"); v != "disk" {
+		t.Errorf("got %v when the DataLoader failed, expected disk", v)
+	}
+	if table.ExistsInMemory("k") {
+		t.Error("disk fallback added to memory")
+	}
+}
+
+func TestInvalidate_clearedByDelete(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			return nil, nil
+		},
+	})
+
+	for _, key := range []string{"a", "p1", "p2"} {
+		table.Add(key, "v")
+		table.Invalidate(key)
+	}
+	// DeleteByPrefix must also clear a mark for a key whose file has already gone
+	if err := os.Remove(table.getFilePath("p2")); err != nil {
+		t.Fatal(err)
+	}
+
+	table.DeleteFromMemoryAndDisk("a")
+	table.DeleteByPrefix("p")
+
+	for _, key := range []string{"a", "p1", "p2"} {
+		if table.isInvalidated(key) {
+			t.Errorf("%q still invalidated after being deleted", key)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package filecache
 
 import (
+	"math"
 	"strings"
 	"sync"
 	"time"
 )
 
+// NoExpiry is returned by RemainingLifetime for items which never expire
+const NoExpiry = time.Duration(math.MaxInt64)
+
 // CacheItem is an individual cache item
 type CacheItem struct {
 	mutex         sync.RWMutex
@@ -16,6 +20,12 @@ type CacheItem struct {
 	accessedOn    time.Time
 	accessCount   int64
 	aboutToExpire CacheKeyCallback
+	clock         Clock
+	raw           bool
+	codec         string
+	table         *CacheTable
+	size          int64
+	sizedBy       *CacheTable // The table whose memory size includes size, nil if not in memory
 }
 
 func NewCacheItem(key string, lifeSpan time.Duration, data interface{}) *CacheItem {
@@ -28,6 +38,7 @@ func NewCacheItem(key string, lifeSpan time.Duration, data interface{}) *CacheIt
 		accessCount:   0,
 		aboutToExpire: nil,
 		data:          data,
+		clock:         RealClock,
 	}
 }
 
@@ -40,37 +51,143 @@ func NewCreatedCacheItem(key string, lifeSpan time.Duration, data interface{}, c
 		accessCount:   0,
 		aboutToExpire: nil,
 		data:          data,
+		clock:         RealClock,
 	}
 }
 
 // IsValid returns true of the key is valid.
 // As we store entries on disk with the key as the filename then we have to prevent certain characters
 // so that we don't break things or expose some filesystem attack.
-// So, "" and any key starting with "." are prohibited.
+// So, "" and any key starting with "." or ending with "." or " " are prohibited.
 // Otherwise the following characters are prohibited anywhere in the key.
-// null (0x0) is also prohibited (Unix)
+// null (0x0) is also prohibited (Unix) as are the control characters 1..31 (Windows)
 // / \ < > : " | ? *
-// Although windows doesn't like characters 1..31 we don't check for them.
+// Windows reserved device names, e.g. CON, NUL or COM1, are also prohibited, either alone or with an extension.
+// A lifeSpan of 0 is valid and means the item never expires from memory.
 func (item *CacheItem) IsValid() bool {
-	return item != nil &&
-		item.key != "" &&
-		item.key[0] != '.' &&
-		!strings.ContainsAny(item.key, "/\\<>:\"|?*\000") &&
-		item.data != nil &&
-		item.lifeSpan > 0
+	if item == nil || !validKey(item.key) {
+		return false
+	}
+
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return item.data != nil && item.lifeSpan >= 0
+}
+
+// validKey returns true if the key can be used as a filename, see IsValid
+func validKey(key string) bool {
+	if key == "" ||
+		key[0] == '.' ||
+		strings.HasSuffix(key, ".") ||
+		strings.HasSuffix(key, " ") ||
+		strings.ContainsAny(key, "/\\<>:\"|?*") {
+		return false
+	}
+
+	for _, c := range key {
+		if c < 32 {
+			return false
+		}
+	}
+
+	return !reservedName(key)
+}
+
+// reservedName returns true if the key is a Windows reserved device name, ignoring any extension
+func reservedName(key string) bool {
+	name := strings.ToUpper(key)
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.TrimRight(name, " ")
+
+	switch name {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+
+	return len(name) == 4 &&
+		(strings.HasPrefix(name, "COM") || strings.HasPrefix(name, "LPT")) &&
+		name[3] >= '1' && name[3] <= '9'
 }
 
 func (item *CacheItem) KeepAlive() {
 	item.mutex.Lock()
 	defer item.mutex.Unlock()
-	item.accessedOn = time.Now()
+	item.accessedOn = item.clock.Now()
 	item.accessCount++
 }
 
 func (item *CacheItem) LifeSpan() time.Duration {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
 	return item.lifeSpan
 }
 
+// SetLifeSpan changes how long the item remains in memory after it was last accessed.
+// A lifeSpan of 0 means the item will never expire from memory.
+// If the item is in a CacheTable then its memory expiry is rescheduled & the new lifeSpan persisted to disk.
+// Once the item has been removed from its table, e.g. deleted or expired, only the item itself is changed.
+// Returns ErrInvalidLifespan if d is negative.
+func (item *CacheItem) SetLifeSpan(d time.Duration) error {
+	if d < 0 {
+		return ErrInvalidLifespan
+	}
+
+	item.mutex.Lock()
+	item.lifeSpan = d
+	table := item.table
+	item.mutex.Unlock()
+
+	if table != nil && table.holds(item) {
+		table.expireMemory()
+		_ = table.persistItem(item)
+	}
+	return nil
+}
+
+// RemainingLifetime returns how long the item has before it expires from memory, honouring the
+// ExpiryPolicy of its table.
+// This returns 0 if the item has already expired or NoExpiry if the item never expires.
+func (item *CacheItem) RemainingLifetime() time.Duration {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+
+	if item.lifeSpan == 0 {
+		return NoExpiry
+	}
+
+	remaining := item.expiresAt(item.policy()).Sub(item.clock.Now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// IsExpired returns true if the item has passed its lifeSpan since it was last accessed,
+// or since it was created if its table uses the SinceCreation ExpiryPolicy.
+// Items with a lifeSpan of 0 never expire.
+func (item *CacheItem) IsExpired() bool {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return item.lifeSpan > 0 && !item.clock.Now().Before(item.expiresAt(item.policy()))
+}
+
+// ExpiresAt returns when the item will expire from memory. This is meaningless if LifeSpan is 0.
+func (item *CacheItem) ExpiresAt() time.Time {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return item.expiresAt(item.policy())
+}
+
+// policy returns the ExpiryPolicy of the item's table
+func (item *CacheItem) policy() ExpiryPolicy {
+	if item.table == nil {
+		return SinceAccess
+	}
+	return item.table.expiryPolicy
+}
+
 func (item *CacheItem) AccessedOn() time.Time {
 	item.mutex.RLock()
 	defer item.mutex.RUnlock()
@@ -92,9 +209,34 @@ func (item *CacheItem) Key() string {
 }
 
 func (item *CacheItem) Data() interface{} {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
 	return item.data
 }
 
+// itemValue is a copy of the fields of an item which are persisted
+type itemValue struct {
+	data      interface{}
+	lifeSpan  time.Duration
+	createdOn time.Time
+	raw       bool
+	codec     string
+}
+
+// value returns a copy of the fields which are persisted, taken under the lock so they are
+// consistent whilst the item is being changed by Update or SetLifeSpan
+func (item *CacheItem) value() itemValue {
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return itemValue{
+		data:      item.data,
+		lifeSpan:  item.lifeSpan,
+		createdOn: item.createdOn,
+		raw:       item.raw,
+		codec:     item.codec,
+	}
+}
+
 // SetAboutToExpireCallback configures a callback, which will be called right before the item is about to be removed from the cache.
 func (item *CacheItem) SetAboutToExpireCallback(f CacheKeyCallback) {
 	item.mutex.Lock()
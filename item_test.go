@@ -0,0 +1,180 @@
+package filecache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetLifeSpan_concurrentWithPersist(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup})
+	item := table.Add("k", "v")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			_ = item.SetLifeSpan(time.Duration(i) * time.Minute)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = table.persistItem(item)
+		}
+	}()
+	wg.Wait()
+
+	if d := item.LifeSpan(); d != 100*time.Minute {
+		t.Errorf("LifeSpan %v", d)
+	}
+}
+
+func TestRemainingLifetime(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true, Clock: clock})
+
+	item := table.AddExpiry("k", 10*time.Second, "v")
+	forever := table.AddExpiry("forever", 0, "v")
+
+	if d := item.RemainingLifetime(); d != 10*time.Second {
+		t.Errorf("RemainingLifetime %v, expected 10s", d)
+	}
+
+	clock.Advance(4 * time.Second)
+	if d := item.RemainingLifetime(); d != 6*time.Second {
+		t.Errorf("RemainingLifetime %v, expected 6s", d)
+	}
+
+	// KeepAlive restarts the lifeSpan
+	item.KeepAlive()
+	clock.Advance(3 * time.Second)
+	if d := item.RemainingLifetime(); d != 7*time.Second {
+		t.Errorf("RemainingLifetime %v after KeepAlive, expected 7s", d)
+	}
+
+	clock.Advance(time.Minute)
+	if d := item.RemainingLifetime(); d != 0 {
+		t.Errorf("RemainingLifetime %v when expired, expected 0", d)
+	}
+
+	if d := forever.RemainingLifetime(); d != NoExpiry {
+		t.Errorf("RemainingLifetime %v, expected NoExpiry", d)
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true, Clock: clock})
+
+	item := table.AddExpiry("k", 10*time.Second, "v")
+	forever := table.AddExpiry("forever", 0, "v")
+
+	tests := []struct {
+		advance time.Duration
+		item    *CacheItem
+		expired bool
+	}{
+		{advance: 0, item: item, expired: false},
+		{advance: 9 * time.Second, item: item, expired: false},
+		{advance: time.Second, item: item, expired: true},
+		{advance: time.Hour, item: forever, expired: false},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		if got := tt.item.IsExpired(); got != tt.expired {
+			t.Errorf("%s at %v IsExpired %v, expected %v", tt.item.Key(), clock.Now(), got, tt.expired)
+		}
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"key", true},
+		{"a.b", true},
+		{"with space", true},
+		{"CONSOLE", true},
+		{"COM0", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".hidden", false},
+		{"trailing.", false},
+		{"trailing ", false},
+		{"a/b", false},
+		{"../etc", false},
+		{`a\b`, false},
+		{"a:b", false},
+		{"a*b", false},
+		{"a?b", false},
+		{`a"b`, false},
+		{"a<b>", false},
+		{"a|b", false},
+		{"a\x00b", false},
+		{"a\x1fb", false},
+		{"a\nb", false},
+		{"CON", false},
+		{"con", false},
+		{"nul.txt", false},
+		{"AUX .log", false},
+		{"COM1", false},
+		{"lpt9", false},
+	}
+	for _, tt := range tests {
+		if got := validKey(tt.key); got != tt.valid {
+			t.Errorf("validKey(%q) %v, expected %v", tt.key, got, tt.valid)
+		}
+	}
+}
+
+func TestSetLifeSpan(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true, Clock: clock})
+
+	item := table.AddExpiry("k", 10*time.Second, "v")
+	clock.Advance(5 * time.Second)
+
+	// Extending the lifeSpan keeps it past its original expiry
+	if err := item.SetLifeSpan(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * time.Second)
+	table.expireMemory()
+	if !table.ExistsInMemory("k") {
+		t.Fatal("expired at its original lifeSpan")
+	}
+
+	// Shortening it below the time since last access expires it straight away
+	if err := item.SetLifeSpan(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if table.ExistsInMemory("k") {
+		t.Error("not expired once its lifeSpan was shortened")
+	}
+
+	if err := item.SetLifeSpan(-time.Second); err != ErrInvalidLifespan {
+		t.Errorf("SetLifeSpan returned %v, expected %v", err, ErrInvalidLifespan)
+	}
+}
+
+func TestSetLifeSpan_afterDelete(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	item := table.Add("k", "v")
+	table.DeleteFromMemoryAndDisk("k")
+
+	// The deleted item must not write its file back
+	if err := item.SetLifeSpan(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if table.Exists("k") {
+		t.Error("deleted item written back to disk")
+	}
+	if item.LifeSpan() != time.Minute {
+		t.Errorf("lifeSpan %v, expected 1m", item.LifeSpan())
+	}
+}
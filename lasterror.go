@@ -0,0 +1,45 @@
+package filecache
+
+import (
+	"time"
+)
+
+// lastError records an error and when it occurred
+type lastError struct {
+	time time.Time
+	err  error
+}
+
+// recordError records the most recent I/O or serialization error for this table and logs it
+func (table *CacheTable) recordError(err error) {
+	if err != nil {
+		table.lastError.Store(lastError{time: table.now(), err: err})
+		table.logger.Printf("filecache %s: %v", table.name, err)
+	}
+}
+
+// LastError returns the most recent persist, decode or disk error encountered by this table
+// and when it occurred. If no error has occurred then this returns a zero time and nil.
+func (table *CacheTable) LastError() (time.Time, error) {
+	if e, ok := table.lastError.Load().(lastError); ok {
+		return e.time, e.err
+	}
+	return time.Time{}, nil
+}
+
+// LastError returns the most recent error encountered by any table in this cache
+// and when it occurred. If no error has occurred then this returns a zero time and nil.
+func (c *Cache) LastError() (time.Time, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var lastTime time.Time
+	var lastErr error
+	for _, t := range c.tables {
+		tm, err := t.LastError()
+		if err != nil && tm.After(lastTime) {
+			lastTime, lastErr = tm, err
+		}
+	}
+	return lastTime, lastErr
+}
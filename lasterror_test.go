@@ -0,0 +1,42 @@
+package filecache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLastError(t *testing.T) {
+	fs := &testFS{}
+	tables := newTestTables(t, CacheConfig{Filesystem: fs},
+		CacheTableConfig{Name: "a", StartupOptions: noStartup},
+		CacheTableConfig{Name: "b", StartupOptions: noStartup},
+	)
+	table := tables[1]
+	cache := table.parent
+
+	if when, err := cache.LastError(); err != nil || !when.IsZero() {
+		t.Fatalf("LastError before any failure %v %v", when, err)
+	}
+
+	failure := errors.New("disk full")
+	fs.writeErr.Store(failure)
+	before := time.Now()
+	table.Add("k", "v")
+	table.Sync()
+
+	when, err := table.LastError()
+	if !errors.Is(err, failure) {
+		t.Errorf("table LastError %v, expected %v", err, failure)
+	}
+	if when.Before(before) {
+		t.Errorf("LastError time %v is before the failure", when)
+	}
+
+	if _, err := cache.LastError(); !errors.Is(err, failure) {
+		t.Errorf("cache LastError %v, expected %v", err, failure)
+	}
+	if _, err := tables[0].LastError(); err != nil {
+		t.Errorf("other table has LastError %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package filecache
+
+// TableHook is called when a CacheTable is added to or removed from a Cache
+type TableHook func(*CacheTable)
+
+// SetTableLifecycleHooks sets the functions called when a CacheTable is added to the cache by
+// AddCache or GetOrCreateCache, or removed by RemoveCache. Either may be nil.
+// The hooks are called without the cache locked so they may call back into the cache.
+func (c *Cache) SetTableLifecycleHooks(added, removed TableHook) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tableAdded = added
+	c.tableRemoved = removed
+}
+
+// call calls the hook with table if both are set
+func (hook TableHook) call(table *CacheTable) {
+	if hook != nil && table != nil {
+		hook(table)
+	}
+}
@@ -0,0 +1,52 @@
+package filecache
+
+import (
+	"testing"
+)
+
+func TestSetTableLifecycleHooks(t *testing.T) {
+	cache := NewCache(CacheConfig{CacheDir: t.TempDir()})
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Stop()
+
+	var added, removed []*CacheTable
+	cache.SetTableLifecycleHooks(
+		func(table *CacheTable) {
+			// The cache is not locked so the hook can call back into it
+			if cache.GetCache(table.Name()) != table {
+				t.Errorf("added table %q not in the cache", table.Name())
+			}
+			added = append(added, table)
+		},
+		func(table *CacheTable) {
+			if cache.GetCache(table.Name()) != nil {
+				t.Errorf("removed table %q still in the cache", table.Name())
+			}
+			removed = append(removed, table)
+		},
+	)
+
+	a, err := cache.AddCache(CacheTableConfig{Name: "a", StartupOptions: noStartup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cache.GetOrCreateCache(CacheTableConfig{Name: "b", StartupOptions: noStartup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetOrCreateCache(CacheTableConfig{Name: "b", StartupOptions: noStartup}); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || added[0] != a || added[1] != b {
+		t.Errorf("added hook called with %v, expected a & b once each", added)
+	}
+
+	if err := cache.RemoveCache("a", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != a {
+		t.Errorf("removed hook called with %v, expected a", removed)
+	}
+}
@@ -0,0 +1,12 @@
+package filecache
+
+// Logger is used to log errors which would otherwise be discarded.
+// *log.Logger implements this interface.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// noopLogger is the default Logger which discards everything
+type noopLogger struct{}
+
+func (noopLogger) Printf(string, ...interface{}) {}
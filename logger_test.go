@@ -0,0 +1,57 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureLogger is a Logger which records everything logged
+type captureLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *captureLogger) Printf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) contains(s string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, m := range l.messages {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	fs := &testFS{}
+	cacheLogger, tableLogger := &captureLogger{}, &captureLogger{}
+	tables := newTestTables(t, CacheConfig{Filesystem: fs, Logger: cacheLogger},
+		CacheTableConfig{Name: "a", StartupOptions: noStartup},
+		CacheTableConfig{Name: "b", StartupOptions: noStartup, Logger: tableLogger},
+	)
+
+	fs.writeErr.Store(errors.New("disk full"))
+	for _, table := range tables {
+		table.Add("k", "v")
+		table.Sync()
+	}
+
+	if !cacheLogger.contains("filecache a: ") || !cacheLogger.contains("disk full") {
+		t.Errorf("Cache Logger did not log the write failure: %v", cacheLogger.messages)
+	}
+	if cacheLogger.contains("filecache b: ") {
+		t.Error("table with its own Logger logged to the Cache Logger")
+	}
+	if !tableLogger.contains("disk full") {
+		t.Errorf("table Logger did not log the write failure: %v", tableLogger.messages)
+	}
+}
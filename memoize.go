@@ -0,0 +1,49 @@
+package filecache
+
+import (
+	"encoding/json"
+)
+
+// Memoize returns a function which caches the results of fn in a CacheTable.
+//
+// keyFunc converts the argument into the key used within the table.
+// On a miss fn is called and, if it succeeds, its result is added to the table.
+//
+// Values are persisted with the table's ToBytes function, JSON by default.
+// If a value read back from the table is not of type V, e.g. it was loaded from disk
+// by a generic FromBytes, then it is converted to V via JSON.
+func Memoize[K comparable, V any](table *CacheTable, keyFunc func(K) string, fn func(K) (V, error)) func(K) (V, error) {
+	return func(arg K) (V, error) {
+		key := keyFunc(arg)
+
+		if item, err := table.Get(key); err == nil {
+			if v, ok := convertValue[V](item.Data()); ok {
+				return v, nil
+			}
+		}
+
+		v, err := fn(arg)
+		if err != nil {
+			return v, err
+		}
+
+		table.Add(key, v)
+		return v, nil
+	}
+}
+
+// convertValue converts a cached value to V, falling back to a JSON round trip
+func convertValue[V any](data interface{}) (V, bool) {
+	if v, ok := data.(V); ok {
+		return v, true
+	}
+
+	var v V
+	b, err := json.Marshal(data)
+	if err != nil {
+		return v, false
+	}
+
+	err = json.Unmarshal(b, &v)
+	return v, err == nil
+}
@@ -0,0 +1,44 @@
+package filecache
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestMemoize(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		ToBytes:        ToJsonBytes,
+		FromBytes: func(b []byte) interface{} {
+			var v interface{}
+			if json.Unmarshal(b, &v) != nil {
+				return nil
+			}
+			return v
+		},
+	})
+
+	calls := make(map[int]int)
+	square := Memoize(table, strconv.Itoa, func(n int) (int, error) {
+		calls[n]++
+		return n * n, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		for n := 1; n <= 4; n++ {
+			if v, err := square(n); err != nil || v != n*n {
+				t.Fatalf("square(%d) = %d, %v", n, v, err)
+			}
+		}
+		// The second time around the values come from disk, decoded as float64
+		table.FlushMemory()
+	}
+
+	for n := 1; n <= 4; n++ {
+		if calls[n] != 1 {
+			t.Errorf("fn called %d times for %d, expected once", calls[n], n)
+		}
+	}
+}
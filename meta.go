@@ -0,0 +1,198 @@
+package filecache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// metaMagic prefixes the metadata stored with each entry on disk
+var metaMagic = []byte("FCM1")
+
+// fileMeta is the metadata of an item stored on disk
+type fileMeta struct {
+	lifeSpan  time.Duration
+	createdOn time.Time
+	raw       bool
+	// codec is the name of the Codec used to encode the value, "" for the table's ToBytes
+	codec string
+	// stream is set when the value was written by AddStream so is stored without compression or encryption
+	stream bool
+	// compressed is set when the value is compressed with gzip
+	compressed bool
+	// checksum is the CRC32 of the value, only present if hasChecksum is set
+	hasChecksum bool
+	checksum    uint32
+}
+
+const (
+	// metaRaw flags the entry as raw bytes which bypass ToBytes/FromBytes
+	metaRaw = 1 << iota
+	// metaChecksum flags the metadata as containing a CRC32 checksum of the value
+	metaChecksum
+	// metaCodec flags the metadata as containing the name of the Codec used to encode the value
+	metaCodec
+	// metaStream flags the value as written by AddStream so it is stored as is
+	metaStream
+	// metaCompressed flags the value as compressed with gzip
+	metaCompressed
+)
+
+// maxCodecNameLen is the longest codec name accepted when reading metadata
+const maxCodecNameLen = 255
+
+// errNoMeta is returned when a file was written before metadata was stored on disk
+var errNoMeta = errors.New("no metadata")
+
+// encodeMeta prefixes val with the metadata including a checksum of val.
+// Streamed entries have no checksum as the value is not known when the metadata is written.
+func encodeMeta(m fileMeta, val []byte) []byte {
+	flags := uint64(metaChecksum)
+	if m.stream {
+		flags = metaStream
+	}
+	if m.raw {
+		flags |= metaRaw
+	}
+	if m.codec != "" {
+		flags |= metaCodec
+	}
+	if m.compressed {
+		flags |= metaCompressed
+	}
+
+	l := len(metaMagic) + 5*binary.MaxVarintLen64 + len(m.codec)
+	b := make([]byte, l, l+len(val))
+	n := copy(b, metaMagic)
+	n += binary.PutVarint(b[n:], int64(m.lifeSpan))
+	n += binary.PutVarint(b[n:], m.createdOn.UnixNano())
+	n += binary.PutUvarint(b[n:], flags)
+	if !m.stream {
+		n += binary.PutUvarint(b[n:], uint64(crc32.ChecksumIEEE(val)))
+	}
+	if m.codec != "" {
+		n += binary.PutUvarint(b[n:], uint64(len(m.codec)))
+		n += copy(b[n:], m.codec)
+	}
+	return append(b[:n], val...)
+}
+
+// decodeMeta returns the metadata and the remaining value.
+// If b has no metadata then this returns errNoMeta along with b unchanged.
+func decodeMeta(b []byte) (fileMeta, []byte, error) {
+	var m fileMeta
+	if !bytes.HasPrefix(b, metaMagic) {
+		return m, b, errNoMeta
+	}
+
+	r := bytes.NewReader(b[len(metaMagic):])
+	err := readMeta(r, &m)
+	if err != nil {
+		return m, nil, corruptOnEOF(err)
+	}
+
+	val := b[len(b)-r.Len():]
+	if m.hasChecksum && crc32.ChecksumIEEE(val) != m.checksum {
+		return m, nil, ErrCorrupt
+	}
+
+	return m, val, nil
+}
+
+// readMeta reads the metadata fields following the magic header
+func readMeta(r io.ByteReader, m *fileMeta) error {
+	lifeSpan, err := binary.ReadVarint(r)
+	if err != nil {
+		return err
+	}
+
+	createdOn, err := binary.ReadVarint(r)
+	if err != nil {
+		return err
+	}
+
+	flags, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	m.lifeSpan = time.Duration(lifeSpan)
+	m.createdOn = time.Unix(0, createdOn)
+	m.raw = flags&metaRaw != 0
+	m.stream = flags&metaStream != 0
+	m.compressed = flags&metaCompressed != 0
+
+	m.hasChecksum = flags&metaChecksum != 0
+	if m.hasChecksum {
+		checksum, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		m.checksum = uint32(checksum)
+	}
+
+	if flags&metaCodec != 0 {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		if l > maxCodecNameLen {
+			return ErrCorrupt
+		}
+		codec := make([]byte, l)
+		for i := range codec {
+			codec[i], err = r.ReadByte()
+			if err != nil {
+				return err
+			}
+		}
+		m.codec = string(codec)
+	}
+
+	return nil
+}
+
+// readFileMeta reads just the metadata from a file on disk
+func (table *CacheTable) readFileMeta(path string) (fileMeta, error) {
+	f, _, m, err := table.openFileMeta(path)
+	if f != nil {
+		_ = f.Close()
+	}
+	return m, err
+}
+
+// openFileMeta opens a file on disk, reading the metadata, returning a reader positioned at the start of the value.
+// The File is returned if it was opened, even on error, so the caller must close it.
+func (table *CacheTable) openFileMeta(path string) (File, *bufio.Reader, fileMeta, error) {
+	var m fileMeta
+
+	f, err := table.fs.Open(path)
+	if err != nil {
+		return nil, nil, m, err
+	}
+
+	r := bufio.NewReader(f)
+
+	// Skip the key header
+	_, hasKey, err := table.readKeyHeader(r)
+	if err != nil {
+		return f, nil, m, err
+	}
+
+	// Metadata is always written after a key header so a file with one but no metadata is corrupt
+	magic, err := r.Peek(len(metaMagic))
+	if err != nil || !bytes.Equal(magic, metaMagic) {
+		if hasKey {
+			return f, nil, m, ErrCorrupt
+		}
+		return f, nil, m, errNoMeta
+	}
+	_, _ = r.Discard(len(metaMagic))
+
+	err = readMeta(r, &m)
+	return f, r, m, corruptOnEOF(err)
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"github.com/peter-mount/filecache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector which exports metrics for every table in a Cache
+type Collector struct {
+	cache       *filecache.Cache
+	items       *prometheus.Desc
+	diskEntries *prometheus.Desc
+	hits        *prometheus.Desc
+	misses      *prometheus.Desc
+	queueLength *prometheus.Desc
+}
+
+// NewCollector creates a Collector for a Cache. Register it with a prometheus.Registerer
+// to export the cache's metrics.
+func NewCollector(cache *filecache.Cache) *Collector {
+	labels := []string{"table"}
+	return &Collector{
+		cache: cache,
+		items: prometheus.NewDesc(
+			"filecache_items",
+			"Number of items in memory",
+			labels, nil),
+		diskEntries: prometheus.NewDesc(
+			"filecache_disk_entries",
+			"Estimated number of entries on disk",
+			labels, nil),
+		hits: prometheus.NewDesc(
+			"filecache_hits",
+			"Number of Gets which found a value, by where it was found, since the table's stats were last reset",
+			[]string{"table", "source"}, nil),
+		misses: prometheus.NewDesc(
+			"filecache_misses",
+			"Number of Gets which did not find a value since the table's stats were last reset",
+			labels, nil),
+		queueLength: prometheus.NewDesc(
+			"filecache_persist_queue_length",
+			"Number of entries waiting to be persisted to disk",
+			labels, nil),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.items
+	ch <- c.diskEntries
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.queueLength
+}
+
+// Collect exports the metrics for every table.
+// The hits & misses are gauges, not counters, as CacheTable.ResetStats resets them, and the disk
+// entries come from CacheTable.DiskCountEstimate so a scrape never walks the disk.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.cache.Tables() {
+		name := t.Name()
+
+		stats := t.Stats()
+
+		ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(t.Count()), name)
+		ch <- prometheus.MustNewConstMetric(c.diskEntries, prometheus.GaugeValue, float64(t.DiskCountEstimate()), name)
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.GaugeValue, float64(stats.MemoryHits), name, "memory")
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.GaugeValue, float64(stats.DiskHits), name, "disk")
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.GaugeValue, float64(stats.Loads), name, "loader")
+		ch <- prometheus.MustNewConstMetric(c.misses, prometheus.GaugeValue, float64(stats.Misses), name)
+		ch <- prometheus.MustNewConstMetric(c.queueLength, prometheus.GaugeValue, float64(t.QueueLength()), name)
+	}
+}
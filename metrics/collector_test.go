@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/peter-mount/filecache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	cache := filecache.NewCache(filecache.CacheConfig{CacheDir: t.TempDir()})
+	table, err := cache.AddCache(filecache.CacheTableConfig{
+		Name:           "test",
+		StartupOptions: -1,
+		SyncPersist:    true,
+		ToBytes:        func(v interface{}) []byte { return []byte(v.(string)) },
+		FromBytes:      func(b []byte) interface{} { return string(b) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Stop()
+
+	table.Add("a", "1")
+	table.Add("b", "2")
+	table.DeleteFromMemory("b")
+	if _, err := table.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = table.Get("missing")
+	table.DiskCount()
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(NewCollector(cache))
+
+	expected := `
+# HELP filecache_disk_entries Estimated number of entries on disk
+# TYPE filecache_disk_entries gauge
+filecache_disk_entries{table="test"} 2
+# HELP filecache_hits Number of Gets which found a value, by where it was found, since the table's stats were last reset
+# TYPE filecache_hits gauge
+filecache_hits{source="disk",table="test"} 1
+filecache_hits{source="loader",table="test"} 0
+filecache_hits{source="memory",table="test"} 1
+# HELP filecache_items Number of items in memory
+# TYPE filecache_items gauge
+filecache_items{table="test"} 2
+# HELP filecache_misses Number of Gets which did not find a value since the table's stats were last reset
+# TYPE filecache_misses gauge
+filecache_misses{table="test"} 1
+# HELP filecache_persist_queue_length Number of entries waiting to be persisted to disk
+# TYPE filecache_persist_queue_length gauge
+filecache_persist_queue_length{table="test"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
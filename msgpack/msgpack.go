@@ -0,0 +1,37 @@
+// Package msgpack provides MessagePack ToBytes & FromBytes functions for use with filecache.CacheTableConfig.
+// It is a separate module so only users of MessagePack depend on the msgpack library.
+package msgpack
+
+import (
+	"reflect"
+
+	vmsgpack "github.com/vmihailenco/msgpack/v5"
+)
+
+// ToMsgpackBytes encodes a value using MessagePack, which is usually smaller and faster than JSON
+func ToMsgpackBytes(v interface{}) []byte {
+	b, err := vmsgpack.Marshal(v)
+	if err == nil {
+		return b
+	}
+	return nil
+}
+
+// MsgpackFromBytes returns a function which decodes MessagePack encoded values of the same type as prototype.
+// The caller supplies the concrete type, e.g. MsgpackFromBytes(MyStruct{}), and the returned values
+// will be of that type, not a pointer to it.
+func MsgpackFromBytes(prototype interface{}) func([]byte) interface{} {
+	t := reflect.TypeOf(prototype)
+	return func(b []byte) interface{} {
+		if b == nil {
+			return nil
+		}
+
+		v := reflect.New(t)
+		err := vmsgpack.Unmarshal(b, v.Interface())
+		if err != nil {
+			return nil
+		}
+		return v.Elem().Interface()
+	}
+}
@@ -0,0 +1,57 @@
+package msgpack
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type record struct {
+	Name    string
+	Count   int
+	Tags    []string
+	Updated time.Time
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Times are decoded in the local time zone
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"struct", record{Name: "a", Count: 3, Tags: []string{"x", "y"}, Updated: now}},
+		{"map", map[string]int{"one": 1, "two": 2}},
+		{"time", now},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := ToMsgpackBytes(test.v)
+			if b == nil {
+				t.Fatal("failed to encode")
+			}
+
+			got := MsgpackFromBytes(test.v)(b)
+			if !reflect.DeepEqual(got, test.v) {
+				t.Errorf("got %#v, expected %#v", got, test.v)
+			}
+
+			j, _ := json.Marshal(test.v)
+			if len(b) >= len(j) {
+				t.Errorf("msgpack %d bytes is not smaller than json %d bytes", len(b), len(j))
+			}
+		})
+	}
+}
+
+func TestFromBytes_invalid(t *testing.T) {
+	if v := MsgpackFromBytes(record{})([]byte{0xc1}); v != nil {
+		t.Errorf("got %v, expected nil", v)
+	}
+	if v := MsgpackFromBytes(record{})(nil); v != nil {
+		t.Errorf("got %v, expected nil", v)
+	}
+}
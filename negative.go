@@ -0,0 +1,48 @@
+package filecache
+
+import (
+	"time"
+)
+
+// isTombstoned returns true if the key was recently found to not exist by the dataLoader
+func (table *CacheTable) isTombstoned(key string) bool {
+	if table.negativeTTL <= 0 {
+		return false
+	}
+
+	table.tombstoneMutex.Lock()
+	defer table.tombstoneMutex.Unlock()
+
+	expires, ok := table.tombstones[key]
+	if ok && !table.now().Before(expires) {
+		delete(table.tombstones, key)
+		ok = false
+	}
+	return ok
+}
+
+// addTombstone records that the dataLoader could not find a key
+func (table *CacheTable) addTombstone(key string) {
+	if table.negativeTTL <= 0 {
+		return
+	}
+
+	table.tombstoneMutex.Lock()
+	defer table.tombstoneMutex.Unlock()
+
+	if table.tombstones == nil {
+		table.tombstones = make(map[string]time.Time)
+	}
+	table.tombstones[key] = table.now().Add(table.negativeTTL)
+}
+
+// clearTombstone removes any tombstone for a key as it now exists
+func (table *CacheTable) clearTombstone(key string) {
+	if table.negativeTTL <= 0 {
+		return
+	}
+
+	table.tombstoneMutex.Lock()
+	defer table.tombstoneMutex.Unlock()
+	delete(table.tombstones, key)
+}
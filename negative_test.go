@@ -0,0 +1,45 @@
+package filecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegativeTTL(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	var calls int
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		Clock:          clock,
+		NegativeTTL:    time.Minute,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			calls++
+			return nil, nil
+		},
+	})
+
+	for i := 0; i < 5; i++ {
+		if _, err := table.Get("missing"); err != ErrKeyNotFound {
+			t.Fatalf("Get returned %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("DataLoader called %d times within NegativeTTL, expected 1", calls)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, err := table.Get("missing"); err != ErrKeyNotFound {
+		t.Fatalf("Get returned %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("DataLoader called %d times after NegativeTTL, expected 2", calls)
+	}
+
+	// Adding the key clears the tombstone, so once out of memory it's read from disk
+	table.Add("missing", "v")
+	table.Sync()
+	table.DeleteFromMemory("missing")
+	if v := mustGet(t, table, "missing"); v != "v" {
+		t.Errorf("got %v", v)
+	}
+}
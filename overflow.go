@@ -0,0 +1,54 @@
+package filecache
+
+// PersistOverflow is the policy used when an entry is persisted whilst the persistence queue is full
+type PersistOverflow int
+
+const (
+	// Block the caller until there is room in the queue. This is the default
+	PersistBlock PersistOverflow = iota
+	// Drop the oldest entry in the queue to make room for the new one
+	PersistDropOldest
+	// Drop the new entry leaving the queue unchanged
+	PersistDropNewest
+)
+
+// queue submits an entry to the persistence queue applying the table's PersistOverflow policy.
+// Dropped entries remain in memory but are not written to disk.
+// Careful: do not run this method unless the persistMutex is read locked!
+func (table *CacheTable) queue(e persistEntry) {
+	// Sync sentinels are never dropped
+	if table.persistOverflow == PersistBlock || e.synced != nil {
+		table.persistQueue <- e
+		return
+	}
+
+	for {
+		select {
+		case table.persistQueue <- e:
+			return
+		default:
+		}
+
+		if table.persistOverflow == PersistDropNewest {
+			table.dropped(e)
+			return
+		}
+
+		select {
+		case old := <-table.persistQueue:
+			if old.synced != nil {
+				// Requeue it, Sync will just wait for anything queued before it
+				table.persistQueue <- old
+			} else {
+				table.dropped(old)
+			}
+		default:
+		}
+	}
+}
+
+// dropped records an entry dropped from the persistence queue
+func (table *CacheTable) dropped(e persistEntry) {
+	table.dequeued(e)
+	table.stats.dropped.Add(1)
+}
@@ -0,0 +1,78 @@
+package filecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPersistOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   PersistOverflow
+		onDisk   []string
+		dropped  []string
+		blocking bool
+	}{
+		{"block", PersistBlock, []string{"a", "b", "c", "d"}, nil, true},
+		{"dropOldest", PersistDropOldest, []string{"a", "c", "d"}, []string{"b"}, false},
+		{"dropNewest", PersistDropNewest, []string{"a", "b", "c"}, []string{"d"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := &testFS{}
+			table := newTestTables(t, CacheConfig{Filesystem: fs}, CacheTableConfig{
+				StartupOptions:   noStartup,
+				PersistQueueSize: 2,
+				PersistOverflow:  test.policy,
+			})[0]
+
+			// Hold the write of a so b & c fill the queue
+			fs.gate = make(chan struct{})
+			writes := fs.writes.Load()
+			table.Add("a", "v")
+			for fs.writes.Load() == writes {
+				time.Sleep(time.Millisecond)
+			}
+			table.Add("b", "v")
+			table.Add("c", "v")
+
+			added := make(chan struct{})
+			go func() {
+				defer close(added)
+				table.Add("d", "v")
+			}()
+
+			select {
+			case <-added:
+				if test.blocking {
+					t.Fatal("Add did not block with the queue full")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if !test.blocking {
+					t.Fatal("Add blocked with the queue full")
+				}
+			}
+
+			close(fs.gate)
+			<-added
+			table.Sync()
+
+			for _, key := range test.onDisk {
+				if !table.existsOnDisk(key) {
+					t.Errorf("%q not written", key)
+				}
+			}
+			for _, key := range test.dropped {
+				if table.existsOnDisk(key) {
+					t.Errorf("%q written", key)
+				}
+				if !table.ExistsInMemory(key) {
+					t.Errorf("dropped %q not in memory", key)
+				}
+			}
+			if d := table.Stats().Dropped; d != int64(len(test.dropped)) {
+				t.Errorf("Dropped %d, expected %d", d, len(test.dropped))
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package filecache
+
+import "time"
+
+// ExpiryPolicy determines when an item's lifeSpan is measured from when expiring items from memory
+type ExpiryPolicy int
+
+const (
+	// Items expire lifeSpan after they were last accessed. This is the default
+	SinceAccess ExpiryPolicy = iota
+	// Items expire lifeSpan after they were created regardless of how often they are accessed
+	SinceCreation
+)
+
+// expiresAt returns when the item expires from memory under policy.
+// Careful: do not run this method unless the item-mutex is locked!
+func (item *CacheItem) expiresAt(policy ExpiryPolicy) time.Time {
+	if policy == SinceCreation {
+		return item.createdOn.Add(item.lifeSpan)
+	}
+	return item.accessedOn.Add(item.lifeSpan)
+}
@@ -0,0 +1,64 @@
+package filecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemainingLifetime_sinceCreation(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		MemoryOnly:     true,
+		Clock:          clock,
+		ExpiryPolicy:   SinceCreation,
+	})
+
+	item := table.AddExpiry("k", 10*time.Second, "v")
+	clock.Advance(8 * time.Second)
+	item.KeepAlive()
+
+	if d := item.RemainingLifetime(); d != 2*time.Second {
+		t.Errorf("RemainingLifetime %v, expected 2s", d)
+	}
+	if d := item.ExpiresAt().Sub(clock.Now()); d != 2*time.Second {
+		t.Errorf("ExpiresAt in %v, expected 2s", d)
+	}
+}
+
+func TestExpiryPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		policy  ExpiryPolicy
+		expired bool
+	}{
+		{"SinceAccess", SinceAccess, false},
+		{"SinceCreation", SinceCreation, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			table := newTestTable(t, CacheTableConfig{
+				StartupOptions: noStartup,
+				MemoryOnly:     true,
+				Clock:          clock,
+				ExpiryPolicy:   tt.policy,
+			})
+
+			table.AddExpiry("k", 10*time.Second, "v")
+
+			// Accessed continuously, SinceCreation must still expire it 10s after it was created
+			for i := 0; i < 3; i++ {
+				clock.Advance(3 * time.Second)
+				if _, err := table.Get("k"); err != nil {
+					t.Fatalf("Get after %d accesses: %v", i, err)
+				}
+			}
+			clock.Advance(time.Second)
+			table.expireMemory()
+
+			if exists := table.ExistsInMemory("k"); exists == tt.expired {
+				t.Errorf("in memory %v 10s after creation with continuous access", exists)
+			}
+		})
+	}
+}
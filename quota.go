@@ -0,0 +1,127 @@
+package filecache
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// diskEntry is a file found on disk
+type diskEntry struct {
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+// diskEntries returns all entries on disk along with their total size
+func (table *CacheTable) diskEntries() ([]diskEntry, int64) {
+	var entries []diskEntry
+	var total int64
+
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		entries = append(entries, diskEntry{key: key, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	return entries, total
+}
+
+// DiskUsage returns the total size in bytes & the number of files of this table's disk cache.
+// This has to walk the disk so the result is not cached, call it on demand.
+func (table *CacheTable) DiskUsage() (bytes int64, files int64) {
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		bytes += info.Size()
+		files++
+		return nil
+	})
+	return bytes, files
+}
+
+// enforceDiskQuota deletes the oldest entries, both from disk and memory, until the total size
+// on disk is no more than maxDiskBytes. Returns the number of entries deleted.
+func (table *CacheTable) enforceDiskQuota() int {
+	if table.maxDiskBytes <= 0 {
+		return 0
+	}
+
+	entries, total := table.diskEntries()
+	if total <= table.maxDiskBytes {
+		return 0
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	deleted := 0
+	for _, e := range entries {
+		if total <= table.maxDiskBytes {
+			break
+		}
+		table.DeleteFromMemoryAndDisk(e.key)
+		table.diskEvicted(e.key)
+		total -= e.size
+		deleted++
+	}
+
+	return deleted
+}
+
+// DiskUsage returns the total size in bytes of the disk cache across all tables.
+// This has to walk the disk of every table.
+func (c *Cache) DiskUsage() int64 {
+	var total int64
+	for _, t := range c.Tables() {
+		size, _ := t.DiskUsage()
+		total += size
+	}
+	return total
+}
+
+// enforceTotalDiskQuota deletes the oldest entries across all tables, both from disk and memory,
+// until the total size on disk is no more than maxTotalDiskBytes. Returns the number of entries deleted.
+// As this walks every table only one runs at a time, if one is already running then this returns 0
+// as that will bring the cache within the quota.
+func (c *Cache) enforceTotalDiskQuota() int {
+	if c.maxTotalDiskBytes <= 0 || !c.quotaMutex.TryLock() {
+		return 0
+	}
+	defer c.quotaMutex.Unlock()
+
+	type tableEntry struct {
+		diskEntry
+		table *CacheTable
+	}
+
+	var entries []tableEntry
+	var total int64
+	for _, t := range c.Tables() {
+		tableEntries, size := t.diskEntries()
+		for _, e := range tableEntries {
+			entries = append(entries, tableEntry{diskEntry: e, table: t})
+		}
+		total += size
+	}
+
+	if total <= c.maxTotalDiskBytes {
+		return 0
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	deleted := 0
+	for _, e := range entries {
+		if total <= c.maxTotalDiskBytes {
+			break
+		}
+		e.table.DeleteFromMemoryAndDisk(e.key)
+		e.table.diskEvicted(e.key)
+		total -= e.size
+		deleted++
+	}
+
+	return deleted
+}
@@ -0,0 +1,111 @@
+package filecache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxDiskBytes(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	now := time.Now()
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		table.Add(key, value)
+		setModTime(t, table, key, now.Add(time.Duration(i-10)*time.Minute))
+	}
+
+	size, _ := table.DiskUsage()
+	table.maxDiskBytes = size / 2
+	table.ExpireDisk()
+
+	size, files := table.DiskUsage()
+	if size > table.maxDiskBytes {
+		t.Errorf("disk usage %d over quota %d", size, table.maxDiskBytes)
+	}
+	if files != 5 {
+		t.Errorf("%d files remain, expected 5", files)
+	}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if exists := table.Exists(key); exists != (i >= 5) {
+			t.Errorf("%q exists %v", key, exists)
+		}
+	}
+}
+
+func TestMaxTotalDiskBytes(t *testing.T) {
+	tables := newTestTables(t, CacheConfig{},
+		CacheTableConfig{Name: "a", StartupOptions: noStartup, SyncPersist: true},
+		CacheTableConfig{Name: "b", StartupOptions: noStartup, SyncPersist: true},
+	)
+	cache := tables[0].parent
+
+	// Interleave the ages so the oldest entries are split across both tables
+	now := time.Now()
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 10; i++ {
+		table, key := tables[i%2], fmt.Sprintf("k%d", i)
+		table.Add(key, value)
+		setModTime(t, table, key, now.Add(time.Duration(i-10)*time.Minute))
+	}
+
+	cache.maxTotalDiskBytes = cache.DiskUsage() / 2
+	tables[0].ExpireDisk()
+
+	if size := cache.DiskUsage(); size > cache.maxTotalDiskBytes {
+		t.Errorf("disk usage %d over quota %d", size, cache.maxTotalDiskBytes)
+	}
+	for i := 0; i < 10; i++ {
+		table, key := tables[i%2], fmt.Sprintf("k%d", i)
+		if exists := table.Exists(key); exists != (i >= 5) {
+			t.Errorf("%s %q exists %v", table.Name(), key, exists)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	if size, files := table.DiskUsage(); size != 0 || files != 0 {
+		t.Errorf("empty table DiskUsage %d %d", size, files)
+	}
+
+	const n, valueSize = 4, 1000
+	for i := 0; i < n; i++ {
+		table.Add(fmt.Sprintf("k%d", i), strings.Repeat("x", valueSize))
+	}
+
+	// Each file holds the value plus a small header
+	size, files := table.DiskUsage()
+	if files != n {
+		t.Errorf("%d files, expected %d", files, n)
+	}
+	if size < n*valueSize || size > n*(valueSize+256) {
+		t.Errorf("%d bytes, expected about %d", size, n*valueSize)
+	}
+}
+
+func TestMaxTotalDiskBytes_enforcedOnceByExpireAll(t *testing.T) {
+	fs := &testFS{}
+	tables := newTestTables(t, CacheConfig{Filesystem: fs, MaxTotalDiskBytes: 1 << 30},
+		CacheTableConfig{Name: "a", StartupOptions: noStartup, SyncPersist: true},
+		CacheTableConfig{Name: "b", StartupOptions: noStartup, SyncPersist: true},
+		CacheTableConfig{Name: "c", StartupOptions: noStartup, SyncPersist: true},
+	)
+	for _, table := range tables {
+		table.Add("k", "v")
+	}
+
+	fs.walks.Store(0)
+	tables[0].parent.ExpireAll()
+
+	// Each table is walked once to expire it & once more for the quota
+	if walks := fs.walks.Load(); walks != 6 {
+		t.Errorf("ExpireAll walked %d times, expected 6", walks)
+	}
+}
@@ -0,0 +1,40 @@
+package filecache
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotBytes is returned by GetBytes when the value was not stored with AddBytes
+	ErrNotBytes = errors.New("notbytes")
+)
+
+// AddBytes adds a raw []byte value with the specified lifeSpan.
+// Unlike Add the value bypasses the table's ToBytes & FromBytes so is stored on disk exactly as supplied.
+// This returns the CacheItem just added or nil if there was an error, usually the key is invalid,
+// the lifeSpan is negative or b is nil
+func (table *CacheTable) AddBytes(key string, lifeSpan time.Duration, b []byte) *CacheItem {
+	item := table.newItem(key, lifeSpan, b)
+	item.raw = true
+	if b == nil || !item.IsValid() {
+		return nil
+	}
+
+	table.mutex.Lock()
+	return table.add(item)
+}
+
+// GetBytes returns the raw value of an entry added with AddBytes.
+// Returns ErrNotBytes if the entry exists but was not added with AddBytes.
+func (table *CacheTable) GetBytes(key string) ([]byte, error) {
+	item, err := table.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !item.raw {
+		return nil, ErrNotBytes
+	}
+	return item.Data().([]byte), nil
+}
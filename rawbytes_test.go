@@ -0,0 +1,29 @@
+package filecache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddBytes(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	b := []byte{0, 1, 2, 0, 0, 0xff, 0xfe, 0}
+	if table.AddBytes("k", 0, b) == nil {
+		t.Fatal("AddBytes failed")
+	}
+	table.FlushMemory()
+
+	got, err := table.GetBytes("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Errorf("got %v, expected %v", got, b)
+	}
+
+	table.Add("string", "v")
+	if _, err := table.GetBytes("string"); err != ErrNotBytes {
+		t.Errorf("GetBytes returned %v, expected %v", err, ErrNotBytes)
+	}
+}
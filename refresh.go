@@ -0,0 +1,23 @@
+package filecache
+
+import (
+	"context"
+)
+
+// refreshAhead refreshes an item in the background via the dataLoader if it is about to expire.
+func (table *CacheTable) refreshAhead(item *CacheItem, args ...interface{}) {
+	if table.refreshAheadTime <= 0 || table.dataLoader == nil || item.RemainingLifetime() >= table.refreshAheadTime {
+		return
+	}
+
+	// Don't start another refresh if one is already in flight
+	table.loadMutex.Lock()
+	_, loading := table.loadCalls[item.key]
+	table.loadMutex.Unlock()
+
+	if !loading {
+		go func() {
+			_, _ = table.loadSingleFlight(context.Background(), item.key, args...)
+		}()
+	}
+}
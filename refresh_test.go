@@ -0,0 +1,59 @@
+package filecache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshAhead(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	var calls atomic.Int32
+	release := make(chan struct{})
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		MemoryOnly:     true,
+		Clock:          clock,
+		RefreshAhead:   5 * time.Second,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			n := calls.Add(1)
+			if n > 1 {
+				<-release
+			}
+			return NewCacheItem(key, 10*time.Second, fmt.Sprintf("v%d", n)), nil
+		},
+	})
+
+	if v := mustGet(t, table, "k"); v != "v1" {
+		t.Fatalf("got %v", v)
+	}
+
+	// Not yet within RefreshAhead of expiring
+	clock.Advance(4 * time.Second)
+	mustGet(t, table, "k")
+	clock.Advance(6 * time.Second)
+
+	// Within the window the current value is returned whilst a single refresh runs
+	for i := 0; i < 10; i++ {
+		if v := mustGet(t, table, "k"); v != "v1" {
+			t.Fatalf("got %v whilst refreshing", v)
+		}
+	}
+	close(release)
+
+	refreshed := func() bool {
+		item, err := table.Peek("k")
+		return err == nil && item.Data() == "v2"
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !refreshed() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if v := mustGet(t, table, "k"); v != "v2" {
+		t.Errorf("got %v, expected the refreshed value", v)
+	}
+	if c := calls.Load(); c != 2 {
+		t.Errorf("DataLoader called %d times, expected 2", c)
+	}
+}
@@ -0,0 +1,105 @@
+package filecache
+
+import (
+	"os"
+)
+
+// RenameKey moves an entry, either in memory or only on disk, to newKey keeping its value, lifeSpan & creation time.
+// The entry under oldKey is removed from both memory & disk, calling the DeleteItem callback, and the entry
+// under newKey is then added & persisted, calling the AddItem callback.
+// Returns ErrInvalidKey if either key is invalid, ErrKeyExists if newKey already exists or ErrKeyNotFound
+// if oldKey does not exist.
+func (table *CacheTable) RenameKey(oldKey, newKey string) error {
+	if !validKey(oldKey) || !validKey(newKey) {
+		return ErrInvalidKey
+	}
+
+	// Ensure any queued write of oldKey is on disk so it cannot recreate the file after we remove it
+	table.Sync()
+
+	table.mutex.Lock()
+
+	if _, exists := table.items[newKey]; exists || table.existsOnDisk(newKey) {
+		table.mutex.Unlock()
+		return ErrKeyExists
+	}
+
+	item, ok := table.items[oldKey]
+	if !ok {
+		var expired bool
+		item, expired = table.diskLoader(oldKey)
+		if item == nil {
+			table.mutex.Unlock()
+			if expired {
+				table.expireDiskKey(oldKey)
+			}
+			return ErrKeyNotFound
+		}
+	}
+
+	item.mutex.RLock()
+	renamed := table.newCreatedItem(newKey, item.lifeSpan, item.data, item.createdOn)
+	renamed.accessCount = item.accessCount
+	renamed.raw = item.raw
+	renamed.codec = item.codec
+	item.mutex.RUnlock()
+
+	table.delete(oldKey)
+	table.dropPendingKey(oldKey)
+	if !table.memoryOnly {
+		err := table.fs.Remove(table.getFilePath(oldKey))
+		if err != nil && !os.IsNotExist(err) {
+			table.recordError(err)
+		} else {
+			table.indexRemove(oldKey)
+		}
+	}
+
+	table.add(renamed)
+	return nil
+}
+
+// CopyKey adds a copy of an entry, either in memory or only on disk, under dst keeping its lifeSpan.
+// The value is deep copied by passing it through ToBytes & FromBytes so the two entries are independent.
+// Returns ErrInvalidKey if either key is invalid, ErrKeyExists if dst already exists or ErrKeyNotFound
+// if src does not exist.
+func (table *CacheTable) CopyKey(src, dst string) error {
+	if !validKey(src) || !validKey(dst) {
+		return ErrInvalidKey
+	}
+
+	table.mutex.Lock()
+
+	if _, exists := table.items[dst]; exists || table.existsOnDisk(dst) {
+		table.mutex.Unlock()
+		return ErrKeyExists
+	}
+
+	item, ok := table.items[src]
+	if !ok {
+		var expired bool
+		item, expired = table.diskLoader(src)
+		if item == nil {
+			table.mutex.Unlock()
+			if expired {
+				table.expireDiskKey(src)
+			}
+			return ErrKeyNotFound
+		}
+	}
+
+	data, err := table.copyData(item)
+	if err != nil {
+		table.mutex.Unlock()
+		return err
+	}
+
+	item.mutex.RLock()
+	copied := table.newItem(dst, item.lifeSpan, data)
+	copied.raw = item.raw
+	copied.codec = item.codec
+	item.mutex.RUnlock()
+
+	table.add(copied)
+	return nil
+}
@@ -0,0 +1,97 @@
+package filecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenameKey(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	table.AddExpiry("memory", time.Hour, "m")
+	table.Add("disk", "d")
+	table.DeleteFromMemory("disk")
+	table.Add("taken", "t")
+
+	for oldKey, newKey := range map[string]string{"memory": "memory2", "disk": "disk2"} {
+		if err := table.RenameKey(oldKey, newKey); err != nil {
+			t.Fatalf("RenameKey(%q, %q): %v", oldKey, newKey, err)
+		}
+		if table.Exists(oldKey) {
+			t.Errorf("%q still exists", oldKey)
+		}
+	}
+
+	if v := mustGet(t, table, "memory2"); v != "m" {
+		t.Errorf("memory2 got %v", v)
+	}
+	table.FlushMemory()
+	item, err := table.Get("memory2")
+	if err != nil || item.LifeSpan() != time.Hour {
+		t.Errorf("memory2 from disk %v %v", item, err)
+	}
+	if v := mustGet(t, table, "disk2"); v != "d" {
+		t.Errorf("disk2 got %v", v)
+	}
+
+	for _, test := range []struct {
+		oldKey, newKey string
+		err            error
+	}{
+		{"memory2", "taken", ErrKeyExists},
+		{"missing", "new", ErrKeyNotFound},
+		{"memory2", ".invalid", ErrInvalidKey},
+	} {
+		if err := table.RenameKey(test.oldKey, test.newKey); err != test.err {
+			t.Errorf("RenameKey(%q, %q) returned %v, expected %v", test.oldKey, test.newKey, err, test.err)
+		}
+	}
+}
+
+func TestCopyKey(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		ToBytes:        ToJsonBytes,
+		FromBytes: JsonFromBytes(func() interface{} {
+			return &[]string{}
+		}),
+	})
+
+	table.AddExpiry("memory", time.Hour, &[]string{"m"})
+	table.Add("disk", &[]string{"d"})
+	table.DeleteFromMemory("disk")
+
+	for src, dst := range map[string]string{"memory": "memory2", "disk": "disk2"} {
+		if err := table.CopyKey(src, dst); err != nil {
+			t.Fatalf("CopyKey(%q, %q): %v", src, dst, err)
+		}
+		a, b := mustGet(t, table, src).(*[]string), mustGet(t, table, dst).(*[]string)
+		if len(*a) != 1 || len(*b) != 1 || (*a)[0] != (*b)[0] {
+			t.Errorf("%q %v and %q %v differ", src, *a, dst, *b)
+		}
+
+		// The copy is independent of the source
+		(*a)[0] = "mutated"
+		if (*b)[0] == "mutated" {
+			t.Errorf("mutating %q changed %q", src, dst)
+		}
+	}
+
+	if item, err := table.Get("memory2"); err != nil || item.LifeSpan() != time.Hour {
+		t.Errorf("memory2 %v %v, expected a lifeSpan of 1h", item, err)
+	}
+
+	for _, test := range []struct {
+		src, dst string
+		err      error
+	}{
+		{"memory", "disk", ErrKeyExists},
+		{"missing", "new", ErrKeyNotFound},
+		{"memory", ".invalid", ErrInvalidKey},
+	} {
+		if err := table.CopyKey(test.src, test.dst); err != test.err {
+			t.Errorf("CopyKey(%q, %q) returned %v, expected %v", test.src, test.dst, err, test.err)
+		}
+	}
+}
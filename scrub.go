@@ -0,0 +1,35 @@
+package filecache
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// Scrub reads every entry on disk, verifying its checksum & decoding it with FromBytes, removing
+// any which fail. This is useful to remove corrupt entries or those which can no longer be decoded
+// after the type stored in the table has changed.
+// Returns the number of entries checked & the number removed.
+func (table *CacheTable) Scrub() (checked, removed int) {
+	var checkedCount, removedCount atomic.Int64
+
+	_ = table.walkParallel(func(key, path string, info os.FileInfo, err error) error {
+		checkedCount.Add(1)
+
+		// Include expired entries, they are left for ExpireDisk
+		if item, _ := table.readDisk(key, true); item != nil {
+			return nil
+		}
+
+		// readDisk removes entries which fail their checksum so it may have already gone
+		err = table.fs.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			table.recordError(err)
+			return nil
+		}
+		table.indexRemove(key)
+		removedCount.Add(1)
+		return nil
+	})
+
+	return int(checkedCount.Load()), int(removedCount.Load())
+}
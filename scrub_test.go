@@ -0,0 +1,52 @@
+package filecache
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		ToBytes:        stringToBytes,
+		// Simulates values which can no longer be decoded after a schema change
+		FromBytes: func(b []byte) interface{} {
+			if strings.HasPrefix(string(b), "old") {
+				return nil
+			}
+			return string(b)
+		},
+	})
+
+	for key, v := range map[string]string{
+		"good1":   "value",
+		"good2":   "value",
+		"old":     "old value",
+		"corrupt": "a value long enough to corrupt",
+	} {
+		table.Add(key, v)
+	}
+	table.FlushMemory()
+
+	path := table.getFilePath("corrupt")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, removed := table.Scrub()
+	if checked != 4 || removed != 2 {
+		t.Errorf("Scrub checked %d removed %d, expected 4 & 2", checked, removed)
+	}
+	for key, exists := range map[string]bool{"good1": true, "good2": true, "old": false, "corrupt": false} {
+		if table.existsOnDisk(key) != exists {
+			t.Errorf("%q exists on disk %v, expected %v", key, !exists, exists)
+		}
+	}
+}
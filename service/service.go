@@ -3,6 +3,7 @@ package service
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"github.com/peter-mount/filecache"
 	"github.com/peter-mount/golib/kernel"
 	"os"
@@ -12,6 +13,7 @@ import (
 type FileCacheService struct {
 	cacheDir *string
 	cache    *filecache.Cache
+	tables   []filecache.CacheTableConfig
 }
 
 func (c *FileCacheService) Name() string {
@@ -35,9 +37,24 @@ func (c *FileCacheService) PostInit() error {
 		CacheDir: *c.cacheDir,
 	})
 
+	for _, cfg := range c.tables {
+		if cfg.Name == "" {
+			return errors.New("cache table name is required")
+		}
+		if _, err := c.cache.AddCache(cfg); err != nil {
+			return fmt.Errorf("cache table %s: %w", cfg.Name, err)
+		}
+	}
+
 	return nil
 }
 
+// AddTables registers tables to be created when the service is initialised.
+// This must be called before PostInit.
+func (c *FileCacheService) AddTables(cfgs ...filecache.CacheTableConfig) {
+	c.tables = append(c.tables, cfgs...)
+}
+
 func (c *FileCacheService) Start() error {
 	return c.cache.Start()
 }
@@ -49,3 +66,8 @@ func (c *FileCacheService) Stop() {
 func (c *FileCacheService) Cache() *filecache.Cache {
 	return c.cache
 }
+
+// GetCache returns the named CacheTable or nil if it doesn't exist
+func (c *FileCacheService) GetCache(name string) *filecache.CacheTable {
+	return c.cache.GetCache(name)
+}
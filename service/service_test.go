@@ -0,0 +1,81 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/peter-mount/filecache"
+)
+
+func newTestService(t *testing.T, cfgs ...filecache.CacheTableConfig) *FileCacheService {
+	dir := t.TempDir()
+	s := &FileCacheService{cacheDir: &dir}
+	s.AddTables(cfgs...)
+	return s
+}
+
+func TestFileCacheService(t *testing.T) {
+	s := newTestService(t,
+		filecache.CacheTableConfig{Name: "a"},
+		filecache.CacheTableConfig{Name: "b"},
+	)
+
+	if err := s.PostInit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for _, name := range []string{"a", "b"} {
+		table := s.GetCache(name)
+		if table == nil {
+			t.Fatalf("table %s not registered", name)
+		}
+		if !table.Started() {
+			t.Errorf("table %s not started", name)
+		}
+	}
+	if s.GetCache("c") != nil {
+		t.Error("GetCache returned an unknown table")
+	}
+	if !s.Cache().Started() {
+		t.Error("cache not started")
+	}
+}
+
+func TestFileCacheService_invalidTables(t *testing.T) {
+	tests := map[string][]filecache.CacheTableConfig{
+		"duplicate": {{Name: "a"}, {Name: "a"}},
+		"noName":    {{Name: ""}},
+	}
+	for name, cfgs := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := newTestService(t, cfgs...).PostInit(); err == nil {
+				t.Error("PostInit did not fail")
+			}
+		})
+	}
+}
+
+func TestFileCacheService_cacheDirRequired(t *testing.T) {
+	t.Setenv("CACHEDIR", "")
+	dir := ""
+	s := &FileCacheService{cacheDir: &dir}
+	if err := s.PostInit(); err == nil {
+		t.Error("PostInit did not fail without a cache directory")
+	}
+}
+
+func TestFileCacheService_cacheDirFromEnvironment(t *testing.T) {
+	t.Setenv("CACHEDIR", t.TempDir())
+	dir := ""
+	s := &FileCacheService{cacheDir: &dir}
+	s.AddTables(filecache.CacheTableConfig{Name: "a"})
+	if err := s.PostInit(); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetCache("a") == nil {
+		t.Error("table not registered")
+	}
+}
@@ -0,0 +1,102 @@
+package filecache
+
+import (
+	"context"
+)
+
+// loadCall is an in-flight or completed DataLoader call
+type loadCall struct {
+	done    chan struct{}
+	item    *CacheItem
+	err     error
+	waiters int                // Callers waiting for the call, guarded by the table's loadMutex
+	cancel  context.CancelFunc // Cancels the call once no callers are waiting
+}
+
+// loadSingleFlight calls the dataLoader for a key ensuring only one call per key is in flight at a time.
+// Concurrent callers for the same key wait for and share the result of the first call.
+//
+// The call runs in its own goroutine and adds a valid item to the table itself, so callers can return
+// as soon as ctx is done without the loaded item being lost to the others. The call's context is only
+// cancelled once every caller waiting on it has returned, or when the table is stopped, so one caller
+// leaving does not fail the others.
+func (table *CacheTable) loadSingleFlight(ctx context.Context, key string, args ...interface{}) (*CacheItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	table.loadMutex.Lock()
+	c, ok := table.loadCalls[key]
+	if !ok {
+		// Keep the first caller's values but not its cancellation, that follows the waiters
+		loadCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &loadCall{done: make(chan struct{}), cancel: cancel}
+		table.loadCalls[key] = c
+
+		go func() {
+			defer close(c.done)
+			defer cancel()
+			if stopCtx := table.stopContext(); stopCtx != nil {
+				defer context.AfterFunc(stopCtx, cancel)()
+			}
+
+			c.item, c.err = table.callDataLoader(loadCtx, key, args...)
+			if c.err == nil && c.item != nil && c.item.IsValid() {
+				table.mutex.Lock()
+				table.add(c.item)
+			}
+
+			table.loadMutex.Lock()
+			if table.loadCalls[key] == c {
+				delete(table.loadCalls, key)
+			}
+			table.loadMutex.Unlock()
+		}()
+	}
+	c.waiters++
+	table.loadMutex.Unlock()
+
+	select {
+	case <-c.done:
+		table.leaveLoad(key, c)
+		return c.item, c.err
+	case <-ctx.Done():
+		table.leaveLoad(key, c)
+		return nil, ctx.Err()
+	}
+}
+
+// leaveLoad removes a waiter from a call, cancelling it if there are none left.
+// A cancelled call is removed so later callers start a new one rather than sharing its failure.
+func (table *CacheTable) leaveLoad(key string, c *loadCall) {
+	table.loadMutex.Lock()
+	defer table.loadMutex.Unlock()
+
+	c.waiters--
+	if c.waiters == 0 {
+		c.cancel()
+		if table.loadCalls[key] == c {
+			delete(table.loadCalls, key)
+		}
+	}
+}
+
+// callDataLoader calls the dataLoader, first waiting for a free slot if maxConcurrentLoads is set.
+// ctx is the call's context so if every caller gives up whilst waiting the slot is never taken.
+func (table *CacheTable) callDataLoader(ctx context.Context, key string, args ...interface{}) (*CacheItem, error) {
+	if table.loadSlots != nil {
+		select {
+		case table.loadSlots <- struct{}{}:
+			defer func() { <-table.loadSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// select picks at random if a slot freed up as ctx was cancelled
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return table.dataLoader(ctx, key, args...)
+}
@@ -0,0 +1,267 @@
+package filecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadSingleFlight_callerCancelDoesNotFailOthers(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		DataLoaderContext: func(ctx context.Context, key string, args ...interface{}) (*CacheItem, error) {
+			close(entered)
+			select {
+			case <-release:
+				return NewCacheItem(key, 0, "loaded"), nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := table.GetContext(ctx, "k")
+		first <- err
+	}()
+	<-entered
+
+	second := make(chan error, 1)
+	go func() {
+		item, err := table.GetContext(context.Background(), "k")
+		if err == nil && item.Data() != "loaded" {
+			err = errors.New("wrong value")
+		}
+		second <- err
+	}()
+	waitForLoadWaiters(t, table, "k", 2)
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first caller got %v, expected context.Canceled", err)
+	}
+
+	close(release)
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Fatalf("second caller got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second caller did not return")
+	}
+}
+
+func TestLoadSingleFlight(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			calls.Add(1)
+			<-release
+			return NewCacheItem(key, 0, "loaded"), nil
+		},
+	})
+
+	const n = 50
+	var started, wg sync.WaitGroup
+	started.Add(n)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			started.Done()
+			item, err := table.Get("k")
+			if err != nil || item.Data() != "loaded" {
+				t.Errorf("Get returned %v %v", item, err)
+			}
+		}()
+	}
+	started.Wait()
+
+	// Give the goroutines time to reach the loader before it completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if c := calls.Load(); c != 1 {
+		t.Errorf("DataLoader called %d times, expected 1", c)
+	}
+}
+
+func TestMaxConcurrentLoads(t *testing.T) {
+	const limit = 3
+	var inFlight, peak atomic.Int32
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions:     noStartup,
+		MaxConcurrentLoads: limit,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return NewCacheItem(key, 0, "loaded"), nil
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if item, err := table.Get(key); err != nil || item.Data() != "loaded" {
+				t.Errorf("Get(%q) returned %v %v", key, item, err)
+			}
+		}(fmt.Sprintf("k%d", i))
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > limit {
+		t.Errorf("%d loads in flight, limit %d", p, limit)
+	}
+}
+
+func TestMaxConcurrentLoads_cancelWhilstQueued(t *testing.T) {
+	var mutex sync.Mutex
+	var loaded []string
+	entered := make(chan struct{}, 3)
+	release := make(chan struct{})
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions:     noStartup,
+		MaxConcurrentLoads: 1,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			mutex.Lock()
+			loaded = append(loaded, key)
+			mutex.Unlock()
+			entered <- struct{}{}
+			<-release
+			return NewCacheItem(key, 0, "loaded"), nil
+		},
+	})
+
+	// Hold the only slot
+	busy := make(chan error, 1)
+	go func() {
+		_, err := table.Get("busy")
+		busy <- err
+	}()
+	<-entered
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan error, 1)
+	go func() {
+		_, err := table.GetContext(ctx, "queued")
+		queued <- err
+	}()
+	waitForLoadWaiters(t, table, "queued", 1)
+
+	cancel()
+	if err := <-queued; !errors.Is(err, context.Canceled) {
+		t.Fatalf("queued Get returned %v, expected context.Canceled", err)
+	}
+
+	close(release)
+	if err := <-busy; err != nil {
+		t.Fatal(err)
+	}
+
+	// The slot is free again & the cancelled Get never reached the loader
+	if _, err := table.Get("next"); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fmt.Sprint(loaded) != "[busy next]" {
+		t.Errorf("DataLoader called for %v, expected [busy next]", loaded)
+	}
+}
+
+// waitForLoadWaiters waits until n callers are waiting on the DataLoader call for key
+func waitForLoadWaiters(t *testing.T, table *CacheTable, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		table.loadMutex.Lock()
+		c := table.loadCalls[key]
+		waiters := 0
+		if c != nil {
+			waiters = c.waiters
+		}
+		table.loadMutex.Unlock()
+
+		if waiters == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers waiting on %q, expected %d", waiters, key, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGetContext_cancel(t *testing.T) {
+	var calls atomic.Int32
+	entered := make(chan struct{})
+	loaderDone := make(chan error, 1)
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		DataLoaderContext: func(ctx context.Context, key string, args ...interface{}) (*CacheItem, error) {
+			calls.Add(1)
+			close(entered)
+			<-ctx.Done()
+			loaderDone <- ctx.Err()
+			return nil, ctx.Err()
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := table.GetContext(ctx, "k")
+		result <- err
+	}()
+	<-entered
+	cancel()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("GetContext returned %v, expected context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetContext did not return once cancelled")
+	}
+
+	// With no other callers waiting the loader is cancelled too
+	select {
+	case err := <-loaderDone:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("DataLoader ctx ended with %v, expected context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DataLoader ctx not done once the only caller cancelled")
+	}
+
+	// An already cancelled context never reaches the loader
+	if _, err := table.GetContext(ctx, "other"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetContext returned %v, expected context.Canceled", err)
+	}
+	if c := calls.Load(); c != 1 {
+		t.Errorf("DataLoader called %d times, expected 1", c)
+	}
+}
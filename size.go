@@ -0,0 +1,82 @@
+package filecache
+
+import "os"
+
+// ItemSize returns the size in bytes of key's file on disk. If the table is MemoryOnly, or the item
+// has not yet been written to disk, then the length of the item's serialized value is returned.
+// Returns ErrInvalidKey if key is invalid or ErrKeyNotFound if it is in neither memory nor disk.
+func (table *CacheTable) ItemSize(key string) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrInvalidKey
+	}
+
+	if !table.memoryOnly {
+		info, err := table.fs.Stat(table.getFilePath(key))
+		if err == nil {
+			return info.Size(), nil
+		}
+		if !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	table.mutex.RLock()
+	item, ok := table.items[key]
+	table.mutex.RUnlock()
+
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+
+	b, err := table.encode(item)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
+
+// setItem puts an item into memory, replacing any existing item with the same key, keeping the
+// running total of the serialized size of the items in memory up to date.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) setItem(item *CacheItem) {
+	if old, ok := table.items[item.key]; ok && old != item {
+		old.unsize()
+	}
+	table.items[item.key] = item
+
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	if item.sizedBy == nil {
+		item.sizedBy = table
+		table.stats.size.Add(item.size)
+	}
+}
+
+// removeItem removes key from memory, keeping the running total of the serialized size up to date.
+// Careful: do not run this method unless the table-mutex is locked!
+func (table *CacheTable) removeItem(key string) {
+	if item, ok := table.items[key]; ok {
+		item.unsize()
+		delete(table.items, key)
+	}
+}
+
+// unsize removes the item's size from the total of the table it was in
+func (item *CacheItem) unsize() {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	if item.sizedBy != nil {
+		item.sizedBy.stats.size.Add(-item.size)
+		item.sizedBy = nil
+	}
+}
+
+// setSize records the serialized size of the item, which may be after it was put into memory
+func (item *CacheItem) setSize(size int) {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	if item.sizedBy != nil {
+		item.sizedBy.stats.size.Add(int64(size) - item.size)
+	}
+	item.size = int64(size)
+}
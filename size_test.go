@@ -0,0 +1,106 @@
+package filecache
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestItemSize(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	table.Add("a", strings.Repeat("x", 100))
+	table.Add("b", strings.Repeat("x", 300))
+
+	info, err := os.Stat(table.getFilePath("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := table.ItemSize("a"); err != nil || size != info.Size() {
+		t.Errorf("ItemSize %d %v, expected the file size %d", size, err, info.Size())
+	}
+
+	if size := table.Stats().Size; size < 400 || size > 500 {
+		t.Errorf("Stats Size %d, expected about 400", size)
+	}
+
+	table.DeleteFromMemory("b")
+	if size := table.Stats().Size; size < 100 || size >= 300 {
+		t.Errorf("Stats Size %d once b left memory, expected about 100", size)
+	}
+
+	if _, err := table.ItemSize("missing"); err != ErrKeyNotFound {
+		t.Errorf("ItemSize returned %v, expected %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestItemSize_memoryOnly(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true})
+
+	table.Add("k", strings.Repeat("x", 100))
+	if size, err := table.ItemSize("k"); err != nil || size != 100 {
+		t.Errorf("ItemSize %d %v, expected 100", size, err)
+	}
+	if size := table.Stats().Size; size != 0 {
+		t.Errorf("Stats Size %d for a MemoryOnly table, expected 0", size)
+	}
+}
+
+func TestItemSize_invalidKey(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup})
+
+	if _, err := table.ItemSize("../escape"); err != ErrInvalidKey {
+		t.Errorf("ItemSize returned %v, expected %v", err, ErrInvalidKey)
+	}
+}
+
+func TestStats_sizeRunningTotal(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup})
+
+	// Sizes are recorded once the queued writes are encoded
+	table.Add("a", strings.Repeat("x", 100))
+	table.Add("b", strings.Repeat("x", 300))
+	table.Sync()
+	if size := table.Stats().Size; size != 400 {
+		t.Errorf("Stats Size %d, expected 400", size)
+	}
+
+	// Replacing an item replaces its size
+	table.Add("b", strings.Repeat("x", 50))
+	table.Sync()
+	if size := table.Stats().Size; size != 150 {
+		t.Errorf("Stats Size %d once b was replaced, expected 150", size)
+	}
+
+	// Size doesn't need the table lock so can't block behind a writer
+	table.mutex.Lock()
+	done := make(chan int64)
+	go func() {
+		done <- table.Stats().Size
+	}()
+	select {
+	case size := <-done:
+		if size != 150 {
+			t.Errorf("Stats Size %d whilst locked, expected 150", size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Stats blocked on the table lock")
+	}
+	table.mutex.Unlock()
+
+	// Reloading from disk records the size read
+	table.FlushMemory()
+	if size := table.Stats().Size; size != 0 {
+		t.Errorf("Stats Size %d once flushed, expected 0", size)
+	}
+	mustGet(t, table, "a")
+	if size := table.Stats().Size; size != 100 {
+		t.Errorf("Stats Size %d once a was reloaded, expected 100", size)
+	}
+
+	table.ResetStats()
+	if size := table.Stats().Size; size != 100 {
+		t.Errorf("Stats Size %d after ResetStats, expected 100", size)
+	}
+}
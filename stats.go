@@ -0,0 +1,79 @@
+package filecache
+
+import (
+	"sync/atomic"
+)
+
+// CacheStats holds the hit/miss statistics for a CacheTable
+type CacheStats struct {
+	// Number of Gets satisfied from memory
+	MemoryHits int64
+	// Number of Gets satisfied from disk
+	DiskHits int64
+	// Number of Gets satisfied by the DataLoader
+	Loads int64
+	// Number of Gets that returned ErrKeyNotFound
+	Misses int64
+	// Number of entries dropped from the persistence queue by the PersistOverflow policy
+	Dropped int64
+	// Approximate total serialized size in bytes of the items in memory.
+	// Items in a MemoryOnly table are never serialized so are not included.
+	Size int64
+}
+
+// Source identifies where GetWithSource found an item
+type Source int
+
+const (
+	// The item was in memory
+	SourceMemory Source = iota
+	// The item was read from disk
+	SourceDisk
+	// The item was loaded by the DataLoader
+	SourceLoader
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceMemory:
+		return "memory"
+	case SourceDisk:
+		return "disk"
+	case SourceLoader:
+		return "loader"
+	default:
+		return "unknown"
+	}
+}
+
+// tableStats holds the live counters for a table
+type tableStats struct {
+	memoryHits atomic.Int64
+	diskHits   atomic.Int64
+	loads      atomic.Int64
+	misses     atomic.Int64
+	dropped    atomic.Int64
+	// size is the running total for CacheStats.Size so isn't reset by ResetStats
+	size atomic.Int64
+}
+
+// Stats returns a snapshot of the hit/miss statistics for this table
+func (table *CacheTable) Stats() CacheStats {
+	return CacheStats{
+		MemoryHits: table.stats.memoryHits.Load(),
+		DiskHits:   table.stats.diskHits.Load(),
+		Loads:      table.stats.loads.Load(),
+		Misses:     table.stats.misses.Load(),
+		Dropped:    table.stats.dropped.Load(),
+		Size:       table.stats.size.Load(),
+	}
+}
+
+// ResetStats resets the hit/miss statistics for this table
+func (table *CacheTable) ResetStats() {
+	table.stats.memoryHits.Store(0)
+	table.stats.diskHits.Store(0)
+	table.stats.loads.Store(0)
+	table.stats.misses.Store(0)
+	table.stats.dropped.Store(0)
+}
@@ -0,0 +1,85 @@
+package filecache
+
+import (
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			if key == "load" {
+				return NewCacheItem(key, 0, "loaded"), nil
+			}
+			return nil, nil
+		},
+	})
+
+	table.Add("memory", "m")
+	table.Add("disk", "d")
+	table.DeleteFromMemory("disk")
+
+	mustGet(t, table, "memory")
+	mustGet(t, table, "disk")
+	mustGet(t, table, "load")
+	if _, err := table.Get("missing"); err != ErrKeyNotFound {
+		t.Fatalf("Get missing returned %v", err)
+	}
+
+	expected := CacheStats{MemoryHits: 1, DiskHits: 1, Loads: 1, Misses: 1}
+	if stats := table.Stats(); stats.MemoryHits != expected.MemoryHits ||
+		stats.DiskHits != expected.DiskHits ||
+		stats.Loads != expected.Loads ||
+		stats.Misses != expected.Misses {
+		t.Errorf("got %+v, expected %+v", stats, expected)
+	}
+
+	table.ResetStats()
+	if stats := table.Stats(); stats.MemoryHits != 0 || stats.DiskHits != 0 || stats.Loads != 0 || stats.Misses != 0 {
+		t.Errorf("after ResetStats got %+v", stats)
+	}
+}
+
+func TestGetWithSource(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			if key == "load" {
+				return NewCacheItem(key, 0, "loaded"), nil
+			}
+			return nil, nil
+		},
+	})
+
+	table.Add("disk", "v")
+	table.FlushMemory()
+	table.Add("memory", "v")
+
+	tests := []struct {
+		key    string
+		source Source
+	}{
+		{"memory", SourceMemory},
+		{"disk", SourceDisk},
+		{"load", SourceLoader},
+		// Both are now in memory
+		{"disk", SourceMemory},
+		{"load", SourceMemory},
+	}
+	for _, tt := range tests {
+		item, source, err := table.GetWithSource(tt.key)
+		if err != nil || item == nil {
+			t.Errorf("GetWithSource(%q) returned %v %v", tt.key, item, err)
+			continue
+		}
+		if source != tt.source {
+			t.Errorf("GetWithSource(%q) source %v, expected %v", tt.key, source, tt.source)
+		}
+	}
+
+	if _, _, err := table.GetWithSource("missing"); err != ErrKeyNotFound {
+		t.Errorf("GetWithSource returned %v, expected %v", err, ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,122 @@
+package filecache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	// ErrMemoryOnly is returned when an operation requires the disk but the table is MemoryOnly
+	ErrMemoryOnly = errors.New("memoryonly")
+	// ErrEncrypted is returned by AddStream when the table has a Cipher as streamed values cannot be encrypted
+	ErrEncrypted = errors.New("encrypted")
+)
+
+// AddStream writes the content of r directly to disk under key with the specified lifeSpan.
+// Unlike AddBytes the value is never held in memory, nor is it compressed or encrypted, so this is
+// suitable for large values. Use GetStream to read it back without loading it into memory.
+// Any copy of key in memory is removed so a Get will read the new value from disk.
+// Returns ErrInvalidKey if the key is invalid, ErrInvalidLifespan if lifeSpan is negative,
+// ErrMemoryOnly if the table is MemoryOnly or ErrEncrypted if the table has a Cipher.
+func (table *CacheTable) AddStream(key string, lifeSpan time.Duration, r io.Reader) error {
+	switch {
+	case !validKey(key):
+		return ErrInvalidKey
+	case lifeSpan < 0:
+		return ErrInvalidLifespan
+	case table.memoryOnly:
+		return ErrMemoryOnly
+	case table.cipher != nil:
+		return ErrEncrypted
+	}
+
+	// Ensure a queued write of key cannot overwrite the stream once written
+	table.Sync()
+
+	header := table.encodeFile(key, encodeMeta(fileMeta{
+		lifeSpan:  lifeSpan,
+		createdOn: table.now(),
+		raw:       true,
+		stream:    true,
+	}, nil))
+
+	dir, fileName := table.getPath(key)
+	err := table.fs.MkdirAll(dir, table.dirMode)
+	if err == nil {
+		err = table.writeStream(dir+PathSeparator+fileName, io.MultiReader(bytes.NewReader(header), r))
+	}
+	if err != nil {
+		table.persistFailed(key, err)
+		return err
+	}
+
+	table.indexAdd(key)
+	table.clearTombstone(key)
+	table.DeleteFromMemory(key)
+	return nil
+}
+
+// writeStream writes a file from r using StreamFilesystem if the Filesystem supports it
+func (table *CacheTable) writeStream(name string, r io.Reader) error {
+	if sfs, ok := table.fs.(StreamFilesystem); ok {
+		return sfs.WriteStream(name, r, table.fileMode)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return table.fs.WriteFile(name, b, table.fileMode)
+}
+
+// GetStream returns a reader of a value written by AddStream, streaming it from disk.
+// The caller must close the returned reader.
+// Values added with AddBytes are also returned, read from memory or disk as with GetBytes.
+// Returns ErrInvalidKey if the key is invalid, ErrKeyNotFound if the key does not exist or ErrNotBytes
+// if the value is not raw bytes.
+func (table *CacheTable) GetStream(key string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	if table.memoryOnly || table.ExistsInMemory(key) {
+		return table.getBytesStream(key)
+	}
+
+	f, r, meta, err := table.openFileMeta(table.getFilePath(key))
+	if err != nil {
+		if f != nil {
+			_ = f.Close()
+		}
+		if os.IsNotExist(err) {
+			table.stats.misses.Add(1)
+			return nil, ErrKeyNotFound
+		}
+		if err != errNoMeta {
+			return nil, err
+		}
+	}
+
+	if !meta.stream {
+		_ = f.Close()
+		return table.getBytesStream(key)
+	}
+
+	table.stats.diskHits.Add(1)
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// getBytesStream returns a reader of a value added with AddBytes
+func (table *CacheTable) getBytesStream(key string) (io.ReadCloser, error) {
+	b, err := table.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
@@ -0,0 +1,42 @@
+package filecache
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup})
+
+	payload := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	if err := table.AddStream("big", 0, bytes.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if table.ExistsInMemory("big") {
+		t.Error("AddStream held the value in memory")
+	}
+
+	r, err := table.GetStream("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got %d bytes, expected %d matching bytes", len(got), len(payload))
+	}
+
+	if _, err := table.GetStream("missing"); err != ErrKeyNotFound {
+		t.Errorf("GetStream returned %v, expected %v", err, ErrKeyNotFound)
+	}
+	if err := table.AddStream("bad/key", 0, bytes.NewReader(payload)); err != ErrInvalidKey {
+		t.Errorf("AddStream returned %v, expected %v", err, ErrInvalidKey)
+	}
+}
@@ -1,9 +1,15 @@
 package filecache
 
 import (
+	"context"
+	"fmt"
+	"hash"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,100 +25,453 @@ type CacheTable struct {
 	diskExpiryTime     time.Duration
 	diskExpiryInterval time.Duration
 	diskExpiryTimer    *time.Timer
+	persistQueueSize   int
 	persistQueue       chan persistEntry
+	persistMutex       sync.RWMutex
+	persistDone        chan struct{}
+	ready              chan struct{}
+	stopTimeout        time.Duration
 	items              map[string]*CacheItem
-	started            bool
+	started            atomic.Bool
 	cleanupTimer       *time.Timer
-	cleanupInterval    time.Duration
-	dataLoader         CacheDataLoader
+	cleanupAt          time.Time
+	dataLoader         CacheDataLoaderContext
 	addItem            CacheItemCallback
 	deleteItem         CacheItemCallback
+	persistError       CacheErrorCallback
+	lazyDirCreate      bool
+	maxQueuedBytes     int
+	queuedBytes        int
+	queueMutex         sync.Mutex
+	queueCond          *sync.Cond
+	lastError          atomic.Value
+	copyOnRead         bool
+	hashFilenames      bool
+	hashFunc           func() hash.Hash
+	compression        Compression
+	cipher             *Cipher
+	stats              tableStats
+	maxMemoryItems     int
+	maxDiskBytes       int64
+	loadMutex          sync.Mutex
+	loadCalls          map[string]*loadCall
+	clock              Clock
+	memoryOnly         bool
+	fs                 Filesystem
+	persistDebounce    time.Duration
+	pending            map[string]persistEntry
+	pendingMutex       sync.Mutex
+	pendingTimer       *time.Timer
+	pendingFlush       sync.Mutex
+	fileMode           os.FileMode
+	dirMode            os.FileMode
+	onDiskEvict        CacheKeyCallback
+	walkConcurrency    int
+	refreshAheadTime   time.Duration
+	serveStaleOnError  bool
+	negativeTTL        time.Duration
+	tombstones         map[string]time.Time
+	tombstoneMutex     sync.Mutex
+	logger             Logger
+	codecs             map[string]Codec
+	persistOverflow    PersistOverflow
+	expiryPolicy       ExpiryPolicy
+	syncPersist        bool
+	loadSlots          chan struct{}
+	invalidated        map[string]bool
+	invalidatedMutex   sync.Mutex
+	persistWorkers     int
+	indexDisk          bool
+	diskIndex          diskIndex
+	lastDiskCount      atomic.Int64
+	stopCtx            context.Context
+	stopCancel         context.CancelFunc
+	listeners          eventListeners
+	fanout             []int
 }
 
 func (table *CacheTable) start() error {
-	table.basePath = table.parent.cacheDir + PathSeparator + table.name
+	// With lazyDirCreate persist will create the directory on the first write
+	if !table.lazyDirCreate && !table.memoryOnly {
+		err := table.fs.MkdirAll(table.basePath, table.dirMode)
+		if err == nil {
+			// Fail now rather than every write failing in the background
+			err = probeWritable(table.fs, table.basePath)
+		}
+		if err != nil {
+			return fmt.Errorf("cache %s: %w", table.name, err)
+		}
+	}
 
-	err := os.MkdirAll(table.basePath, 0777)
-	if err != nil {
-		return err
+	// The background persistence channel.
+	// This will be nil if the table has been stopped so create a new one
+	table.persistMutex.Lock()
+	if table.persistQueue == nil {
+		table.persistQueue = make(chan persistEntry, table.persistQueueSize)
 	}
+	queue := table.persistQueue
+	done := make(chan struct{})
+	table.persistDone = done
+	table.stopCtx, table.stopCancel = context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	table.ready = ready
+	table.persistMutex.Unlock()
 
-	// The background persistence channel
-	table.started = true
+	table.started.Store(true)
 	go func() {
-		for table.started {
-			e := <-table.persistQueue
-			table.persist(e)
-		}
+		defer close(done)
+		table.drainQueue(queue)
 	}()
 
+	// Re-arm the memory expiry timer which isn't run whilst the table is stopped
+	table.expireMemory()
+
+	// Build the disk index in the background, Exists checks the disk until it completes
+	if table.indexDisk && !table.memoryOnly {
+		go table.buildDiskIndex()
+	}
+
 	// Startup options.
 	// Note we only start the disk expiry timer as the default as the other options will
 	// start it when they complete.
 	// The methods are called in a go routine so the application isn't held up whilst the
-	// cleanup is being performed
+	// cleanup is being performed. ready is closed once they complete, see WaitUntilReady
 	switch table.startupOptions {
 	case FlushCacheOnStart:
-		go table.FlushDisk()
+		go table.startup(ready, table.FlushDisk)
 	case ExpireCacheOnStart:
-		go table.ExpireDisk()
+		go table.startup(ready, func() { table.ExpireDisk() })
 	case LoadCacheOnStart:
-		go table.loadCache(table.expiryTime)
+		go table.startup(ready, func() { table.loadCache(table.expiryTime) })
 	case LoadEntireCacheOnStart:
-		go table.loadCache(0)
+		go table.startup(ready, func() { table.loadCache(0) })
 	default:
 		table.startDiskExpiryTimer()
+		close(ready)
 	}
 
 	return nil
 }
 
 func (table *CacheTable) stop() {
-	if table.started {
+	// CompareAndSwap so only one caller stops the table
+	if table.started.CompareAndSwap(true, false) {
 		table.stopDiskExpiryTimer()
-		table.started = false
+
+		table.mutex.Lock()
+		table.stopMemoryExpiryTimer()
+		table.mutex.Unlock()
+
+		// Submit anything waiting to be coalesced then close the queue so the persistence
+		// goroutine exits once it has drained it
+		table.flushPending()
+		table.persistMutex.Lock()
+		table.stopCancel()
+		table.stopCtx = nil
+		close(table.persistQueue)
+		table.persistQueue = nil
+		done := table.persistDone
+		table.persistMutex.Unlock()
+
+		if table.stopTimeout > 0 {
+			select {
+			case <-done:
+			case <-time.After(table.stopTimeout):
+			}
+		} else {
+			<-done
+		}
 	}
 }
 
 type persistEntry struct {
-	key string
-	val []byte
+	key    string
+	val    []byte
+	meta   fileMeta
+	synced chan struct{} // If set then this is a sentinel used by Sync
+}
+
+// Sync blocks until all entries queued for persistence have been written to disk.
+func (table *CacheTable) Sync() {
+	if table.memoryOnly || !table.started.Load() {
+		return
+	}
+
+	table.flushPending()
+
+	synced := make(chan struct{})
+	table.send(persistEntry{synced: synced})
+	<-synced
+}
+
+// enqueue submits an entry to be persisted.
+// If persistDebounce is set the entry is held so that rapid writes to the same key are coalesced.
+func (table *CacheTable) enqueue(e persistEntry) {
+	if table.memoryOnly {
+		return
+	}
+
+	if table.persistDebounce > 0 {
+		table.coalesce(e)
+	} else {
+		table.send(e)
+	}
 }
 
-func (table *CacheTable) persist(e persistEntry) {
+// send submits an entry to the persistence queue.
+// If maxQueuedBytes is set this will block until there is room for the entry.
+func (table *CacheTable) send(e persistEntry) {
+	table.persistMutex.RLock()
+	defer table.persistMutex.RUnlock()
+
+	// Once stopped there's no goroutine so write it directly so it isn't lost
+	if table.persistQueue == nil {
+		if e.synced != nil {
+			close(e.synced)
+		} else {
+			_ = table.persist(e)
+		}
+		return
+	}
+
+	if table.maxQueuedBytes > 0 {
+		table.queueMutex.Lock()
+		for table.queuedBytes > 0 && table.queuedBytes+len(e.val) > table.maxQueuedBytes {
+			table.queueCond.Wait()
+		}
+		table.queuedBytes += len(e.val)
+		table.queueMutex.Unlock()
+	}
+
+	table.queue(e)
+}
+
+// dequeued releases the space used by an entry once it has been persisted
+func (table *CacheTable) dequeued(e persistEntry) {
+	if table.maxQueuedBytes > 0 {
+		table.queueMutex.Lock()
+		table.queuedBytes -= len(e.val)
+		table.queueMutex.Unlock()
+		table.queueCond.Broadcast()
+	}
+}
+
+// persist writes an entry to disk, reporting any failure via persistFailed
+func (table *CacheTable) persist(e persistEntry) error {
 	dir, fileName := table.getPath(e.key)
 
-	_ = os.MkdirAll(dir, 0777)
+	val := e.val
+	var err error
+	if table.compression == GzipCompression {
+		val, err = compress(val)
+		e.meta.compressed = true
+	}
+	if err == nil {
+		val, err = table.encrypt(val)
+	}
+	if err == nil {
+		err = table.fs.MkdirAll(dir, table.dirMode)
+	}
+	if err == nil {
+		err = table.fs.WriteFile(dir+PathSeparator+fileName, table.encodeFile(e.key, encodeMeta(e.meta, val)), table.fileMode)
+	}
 
-	_ = ioutil.WriteFile(dir+PathSeparator+fileName, e.val, 0655)
+	if err != nil {
+		table.persistFailed(e.key, err)
+	} else {
+		table.indexAdd(e.key)
+	}
+	return err
 }
 
-// dataLoader used by the memory cache to read from disk when an entry is not on disk
-func (table *CacheTable) diskLoader(key string) *CacheItem {
-	file, err := os.Open(table.getFilePath(key))
+// persistFailed reports an entry which failed to persist
+func (table *CacheTable) persistFailed(key string, err error) {
+	err = fmt.Errorf("persist %q: %w", key, err)
+	table.recordError(err)
+	if table.persistError != nil {
+		table.persistError(key, err)
+	}
+}
+
+// dataLoader used by the memory cache to read from disk when an entry is not on disk.
+// expired is true if the entry is a miss as it has passed the disk expiry time, in which case the caller
+// should call expireDiskKey once it doesn't have the table-mutex locked, unless it is only iterating over entries.
+func (table *CacheTable) diskLoader(key string) (item *CacheItem, expired bool) {
+	return table.readDisk(key, false)
+}
+
+// readDisk reads an item from disk.
+// If includeExpired is true then entries which have passed the disk expiry time are also returned,
+// otherwise they are a miss with expired set. The file is left on disk for the caller, see expireDiskKey.
+func (table *CacheTable) readDisk(key string, includeExpired bool) (item *CacheItem, expired bool) {
+	if table.memoryOnly {
+		return nil, false
+	}
+
+	// An entry waiting to be coalesced is in neither memory nor on disk so read the pending value
+	if e, ok := table.pendingEntry(key); ok {
+		return table.decodeItem(key, e.meta, append([]byte(nil), e.val...)), false
+	}
+
+	path := table.getFilePath(key)
+	file, err := table.fs.Open(path)
 	if err != nil {
-		return nil
+		// Not existing is just a miss
+		if !os.IsNotExist(err) {
+			table.recordError(err)
+		}
+		return nil, false
 	}
 	defer file.Close()
 
 	b, err := ioutil.ReadAll(file)
 	if err != nil {
-		return nil
+		table.recordError(err)
+		return nil, false
 	}
 
 	info, err := file.Stat()
 	if err != nil {
+		table.recordError(err)
+		return nil, false
+	}
+
+	// Files written before metadata was stored use the table's expiry time & the file's modification time
+	meta := fileMeta{lifeSpan: table.expiryTime, createdOn: info.ModTime()}
+
+	b, err = table.decodeFile(key, b)
+	if err == nil {
+		if m, val, metaErr := decodeMeta(b); metaErr != errNoMeta {
+			meta, b, err = m, val, metaErr
+		}
+	}
+	if err == ErrCorrupt {
+		// Remove corrupt entries so they don't keep failing
+		err = fmt.Errorf("%q: %w", key, err)
+		_ = table.fs.Remove(path)
+		table.indexRemove(key)
+	}
+	if err == nil && !includeExpired && diskExpired(table.now(), info.ModTime(), table.diskExpiryTime, meta.lifeSpan) {
+		return nil, true
+	}
+	if err == nil && !meta.stream {
+		b, err = table.decrypt(b)
+		if err == nil && meta.compressed {
+			b, err = decompress(b)
+		}
+	}
+	if err != nil {
+		table.recordError(err)
+		return nil, false
+	}
+
+	return table.decodeItem(key, meta, b), false
+}
+
+// expireDiskKey removes key's file once a read has found it has passed the disk expiry time, rather than
+// waiting for ExpireDisk, reporting it as a disk eviction. The file is kept if it may be needed to serve
+// stale on a DataLoader error, or if the key is in memory as the file then backs a hot item.
+// Careful: do not run this method with the table-mutex locked as it calls the callbacks!
+func (table *CacheTable) expireDiskKey(key string) {
+	if table.serveStaleOnError {
+		return
+	}
+
+	table.mutex.Lock()
+	if _, ok := table.items[key]; ok {
+		table.mutex.Unlock()
+		return
+	}
+	err := table.fs.Remove(table.getFilePath(key))
+	table.mutex.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		table.recordError(err)
+		return
+	}
+	table.indexRemove(key)
+	table.diskEvicted(key)
+}
+
+// decodeItem returns the item for a value read from disk, after it has been decrypted & decompressed
+func (table *CacheTable) decodeItem(key string, meta fileMeta, b []byte) *CacheItem {
+	if meta.raw {
+		item := table.newCreatedItem(key, meta.lifeSpan, b, meta.createdOn)
+		item.raw = true
+		item.size = int64(len(b))
+		return item
+	}
+
+	_, fromBytes, err := table.codecFuncs(meta.codec)
+	if err != nil {
+		table.recordError(fmt.Errorf("failed to decode %q: %w", key, err))
 		return nil
 	}
 
-	val := table.fromBytes(b)
+	val, err := safeFromBytes(fromBytes, b)
 	if val != nil {
-		return NewCreatedCacheItem(key, table.expiryTime, val, info.ModTime())
+		item := table.newCreatedItem(key, meta.lifeSpan, val, meta.createdOn)
+		item.codec = meta.codec
+		item.size = int64(len(b))
+		return item
 	}
 
+	if err != nil {
+		table.recordError(fmt.Errorf("failed to decode %q: %w", key, err))
+	} else {
+		table.recordError(fmt.Errorf("failed to decode %q", key))
+	}
 	return nil
 }
 
+// stopContext returns a context which is cancelled when the table is stopped, nil if not started
+func (table *CacheTable) stopContext() context.Context {
+	table.persistMutex.RLock()
+	defer table.persistMutex.RUnlock()
+	return table.stopCtx
+}
+
+// Started returns true if this table has been started
+func (table *CacheTable) Started() bool {
+	return table.started.Load()
+}
+
+// startup runs a startup option then closes ready
+func (table *CacheTable) startup(ready chan struct{}, f func()) {
+	defer close(ready)
+	f()
+}
+
+// WaitUntilReady blocks until the table's startup option, e.g. LoadCacheOnStart, has completed.
+// Returns ErrNotStarted if the table has never been started or ctx's error if ctx is done first.
+func (table *CacheTable) WaitUntilReady(ctx context.Context) error {
+	table.persistMutex.RLock()
+	ready := table.ready
+	table.persistMutex.RUnlock()
+
+	if ready == nil {
+		return ErrNotStarted
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Name returns the name of this table
+func (table *CacheTable) Name() string {
+	return table.name
+}
+
+// QueueLength returns how many entries are waiting to be persisted to disk
+func (table *CacheTable) QueueLength() int {
+	table.persistMutex.RLock()
+	defer table.persistMutex.RUnlock()
+	return len(table.persistQueue)
+}
+
 // Count returns how many items are in memory
 func (table *CacheTable) Count() int {
 	table.mutex.RLock()
@@ -120,6 +479,42 @@ func (table *CacheTable) Count() int {
 	return len(table.items)
 }
 
+// KeysInMemory returns the keys of all items in memory
+func (table *CacheTable) KeysInMemory() []string {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	keys := make([]string, 0, len(table.items))
+	for k := range table.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Keys returns the keys of all items either in memory or on disk.
+// Unlike KeysInMemory this has to walk the disk.
+func (table *CacheTable) Keys() []string {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	seen := make(map[string]bool, len(table.items))
+	keys := make([]string, 0, len(table.items))
+	for k := range table.items {
+		seen[k] = true
+		keys = append(keys, k)
+	}
+
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	return keys
+}
+
 // Foreach calls a CacheItemWalker for each key,value in memory
 func (table *CacheTable) Foreach(f CacheItemWalker) {
 	table.mutex.RLock()
@@ -130,63 +525,227 @@ func (table *CacheTable) Foreach(f CacheItemWalker) {
 	}
 }
 
+// ForeachSorted calls a CacheItemWalker for each key,value in memory in the order of their keys.
+// less compares two keys, if nil then keys are sorted lexically.
+// The items are collected under the table's read lock so f is free to call back into the table.
+func (table *CacheTable) ForeachSorted(less func(a, b string) bool, f CacheItemWalker) {
+	table.mutex.RLock()
+	keys := make([]string, 0, len(table.items))
+	items := make(map[string]*CacheItem, len(table.items))
+	for k, v := range table.items {
+		keys = append(keys, k)
+		items[k] = v
+	}
+	table.mutex.RUnlock()
+
+	if less == nil {
+		sort.Strings(keys)
+	} else {
+		sort.Slice(keys, func(i, j int) bool {
+			return less(keys[i], keys[j])
+		})
+	}
+
+	for _, k := range keys {
+		f(k, items[k])
+	}
+}
+
+// ForeachE calls a CacheItemWalkerE for each key,value in memory until it returns an error.
+// If that error is ErrStopIteration then this returns nil, otherwise the error is returned.
+func (table *CacheTable) ForeachE(f CacheItemWalkerE) error {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	for k, v := range table.items {
+		if err := f(k, v); err != nil {
+			if err == ErrStopIteration {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ForeachDisk calls a CacheItemWalker for each entry on disk.
+// The items passed have nil data, use ForeachDiskData if the values are required.
 func (table *CacheTable) ForeachDisk(f CacheItemWalker) {
 	table.mutex.RLock()
 	defer table.mutex.RUnlock()
 
 	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
-		f(key, NewCreatedCacheItem(key, table.expiryTime, nil, info.ModTime()))
+		f(key, table.newCreatedItem(key, table.expiryTime, nil, info.ModTime()))
 		return nil
 	})
 
 }
 
+// ForeachDiskData calls a CacheItemWalker for each entry on disk with the value loaded from disk.
+// Be warned this reads & decodes every file so can be slow on a large disk cache.
+// Entries which cannot be read are skipped.
+func (table *CacheTable) ForeachDiskData(f CacheItemWalker) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		// Expired files are left for ExpireDisk as the key may still be in memory
+		if item, _ := table.diskLoader(key); item != nil {
+			f(key, item)
+		}
+		return nil
+	})
+}
+
 func (table *CacheTable) add(item *CacheItem) *CacheItem {
 	// Careful: do not run this method unless the table-mutex is locked!
 	// It will unlock it for the caller before running the callbacks and checks
-	table.items[item.key] = item
+	_ = table.addAll([]*CacheItem{item})
+	return item
+}
+
+// addAll adds items to the table, returning the first error from persisting them
+func (table *CacheTable) addAll(items []*CacheItem) error {
+	// Careful: do not run this method unless the table-mutex is locked!
+	// It will unlock it for the caller before running the callbacks and checks
+	for _, item := range items {
+		table.setItem(item)
+		table.clearTombstone(item.key)
+		table.clearInvalidated(item.key)
+
+		// Items from a DataLoader use the real clock so use the table's
+		item.mutex.Lock()
+		item.clock = table.clock
+		item.table = table
+		item.mutex.Unlock()
+	}
+	table.evictLRU()
 
 	// Cache values so we don't keep blocking the mutex.
-	expDur := table.cleanupInterval
+	cleanupAt := table.cleanupAt
 	addItem := table.addItem
 	table.mutex.Unlock()
 
-	if addItem != nil {
-		addItem(item)
+	expire := false
+	for _, item := range items {
+		if addItem != nil {
+			addItem(item)
+		}
+		table.publish(EventAdd, item.key, item)
+
+		// If we haven't set up any expiration check timer or found a more imminent item.
+		if item.LifeSpan() > 0 && (cleanupAt.IsZero() || item.ExpiresAt().Before(cleanupAt)) {
+			expire = true
+		}
 	}
 
-	// If we haven't set up any expiration check timer or found a more imminent item.
-	if item.lifeSpan > 0 && (expDur == 0 || item.lifeSpan < expDur) {
+	if expire {
 		table.expireMemory()
 	}
 
-	b := table.toBytes(item.data)
-	if b != nil {
-		table.persistQueue <- persistEntry{item.key, b}
+	var err error
+	for _, item := range items {
+		if persistErr := table.persistItem(item); err == nil {
+			err = persistErr
+		}
 	}
+	return err
+}
 
-	return item
+// persistItem queues an item to be persisted to disk, or with syncPersist writes it immediately
+// returning any error.
+// If the item cannot be encoded then this is reported via the persistError callback & ErrEncode returned.
+func (table *CacheTable) persistItem(item *CacheItem) error {
+	if table.memoryOnly {
+		return nil
+	}
+
+	v := item.value()
+	b, err := table.encodeValue(v)
+	if err != nil {
+		table.persistFailed(item.key, err)
+		return err
+	}
+	item.setSize(len(b))
+
+	e := persistEntry{
+		key:  item.key,
+		val:  b,
+		meta: fileMeta{lifeSpan: v.lifeSpan, createdOn: v.createdOn, raw: v.raw, codec: v.codec},
+	}
+
+	if table.syncPersist {
+		return table.persist(e)
+	}
+
+	table.enqueue(e)
+	return nil
+}
+
+// encode returns the bytes to persist for an item, bypassing toBytes for raw items
+// and using the item's Codec if it has one.
+// Returns ErrEncode if the value could not be encoded, wrapped with ErrPanic if toBytes panicked.
+func (table *CacheTable) encode(item *CacheItem) ([]byte, error) {
+	return table.encodeValue(item.value())
+}
+
+// encodeValue is encode for a copy of an item's value
+func (table *CacheTable) encodeValue(v itemValue) ([]byte, error) {
+	if v.raw {
+		return v.data.([]byte), nil
+	}
+	toBytes, _, err := table.codecFuncs(v.codec)
+	if err != nil {
+		return nil, ErrEncode
+	}
+	b, err := safeToBytes(toBytes, v.data)
+	if err == nil && b == nil {
+		err = ErrEncode
+	}
+	return b, err
 }
 
 // Add adds a key/value pair to the cache using the default expiry time for this table.
 // This returns the CacheItem just added or nil if there was an error, usually the key is invalid
 // or data is nil
 func (table *CacheTable) Add(key string, data interface{}) *CacheItem {
-	return table.AddExpiry(key, table.expiryTime, data)
+	item, _ := table.AddErr(key, data)
+	return item
+}
+
+// AddErr is the same as Add but returns an error describing why the item could not be added:
+// ErrInvalidKey, ErrNilData or ErrInvalidLifespan
+func (table *CacheTable) AddErr(key string, data interface{}) (*CacheItem, error) {
+	return table.AddExpiryErr(key, table.expiryTime, data)
 }
 
-// AddExpiry adds a key/value pair with the specified lifeSpan.
+// AddExpiry adds a key/value pair with the specified lifeSpan. A lifeSpan of 0 means the item will
+// never expire from memory.
 // This returns the CacheItem just added or nil if there was an error, usually the key is invalid
 // the lifeSpan is negative or data is nil
 func (table *CacheTable) AddExpiry(key string, lifeSpan time.Duration, data interface{}) *CacheItem {
-	item := NewCacheItem(key, lifeSpan, data)
-	if !item.IsValid() {
-		return nil
+	item, _ := table.AddExpiryErr(key, lifeSpan, data)
+	return item
+}
+
+// AddExpiryErr is the same as AddExpiry but returns an error describing why the item could not be added:
+// ErrInvalidKey, ErrNilData or ErrInvalidLifespan.
+// If the item was added to memory but could not be persisted, either as it could not be encoded or with
+// SyncPersist the write failed, then the item is returned along with that error.
+func (table *CacheTable) AddExpiryErr(key string, lifeSpan time.Duration, data interface{}) (*CacheItem, error) {
+	switch {
+	case !validKey(key):
+		return nil, ErrInvalidKey
+	case data == nil:
+		return nil, ErrNilData
+	case lifeSpan < 0:
+		return nil, ErrInvalidLifespan
 	}
 
 	// Add item to cache.
+	item := table.newItem(key, lifeSpan, data)
 	table.mutex.Lock()
-	return table.add(item)
+	return item, table.addAll([]*CacheItem{item})
 }
 
 // NotFoundAdd will add a key, value pair to the cache only if the key does not already exist either in memory or disk.
@@ -195,14 +754,18 @@ func (table *CacheTable) NotFoundAdd(key string, data interface{}) bool {
 }
 
 // NotFoundAddExpiry will add a key, value pair to the cache only if the key does not already exist either in memory or disk.
+// As with AddExpiry nothing is added if the key is invalid, the lifeSpan is negative or data is nil.
 func (table *CacheTable) NotFoundAddExpiry(key string, lifeSpan time.Duration, data interface{}) bool {
+	if !validKey(key) || data == nil || lifeSpan < 0 {
+		return false
+	}
+
 	table.mutex.Lock()
 
 	_, ok := table.items[key]
 
 	if !ok {
-		_, err := os.Stat(table.getFilePath(key))
-		ok = !os.IsNotExist(err)
+		ok = table.existsOnDisk(key)
 	}
 
 	if ok {
@@ -210,7 +773,59 @@ func (table *CacheTable) NotFoundAddExpiry(key string, lifeSpan time.Duration, d
 		return false
 	}
 
-	return table.add(NewCacheItem(key, lifeSpan, data)) != nil
+	return table.add(table.newItem(key, lifeSpan, data)) != nil
+}
+
+// Update replaces the data of an existing item, keeping its creation time, access count and lifeSpan,
+// and persists the new value to disk.
+// If the item is only on disk then it is loaded & added to memory as Add would.
+// Returns ErrInvalidKey if the key is invalid or ErrKeyNotFound if the key is in neither memory or disk.
+func (table *CacheTable) Update(key string, data interface{}) (*CacheItem, error) {
+	switch {
+	case !validKey(key):
+		return nil, ErrInvalidKey
+	case data == nil:
+		return nil, ErrNilData
+	}
+
+	table.mutex.Lock()
+	item, ok := table.items[key]
+	if !ok {
+		var expired bool
+		item, expired = table.diskLoader(key)
+		if item == nil {
+			table.mutex.Unlock()
+			if expired {
+				table.expireDiskKey(key)
+			}
+			return nil, ErrKeyNotFound
+		}
+
+		// Not yet visible so replace the data before adding it
+		if err := item.replaceData(data); err != nil {
+			table.mutex.Unlock()
+			return nil, err
+		}
+		return item, table.addAll([]*CacheItem{item})
+	}
+	table.mutex.Unlock()
+
+	if err := item.replaceData(data); err != nil {
+		return nil, err
+	}
+	return item, table.persistItem(item)
+}
+
+// replaceData replaces the item's data, returning ErrNotBytes if the item is raw & data is not a []byte
+func (item *CacheItem) replaceData(data interface{}) error {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+
+	if _, isBytes := data.([]byte); item.raw && !isBytes {
+		return ErrNotBytes
+	}
+	item.data = data
+	return nil
 }
 
 func (table *CacheTable) delete(key string) {
@@ -220,8 +835,8 @@ func (table *CacheTable) delete(key string) {
 	}
 
 	// No callbacks then just delete it
-	if table.deleteItem == nil && r.aboutToExpire == nil {
-		delete(table.items, key)
+	if table.deleteItem == nil && r.aboutToExpire == nil && !table.hasListeners(EventDelete) {
+		table.removeItem(key)
 		return
 	}
 
@@ -229,7 +844,7 @@ func (table *CacheTable) delete(key string) {
 	table.mutex.Unlock()
 	defer func() {
 		table.mutex.Lock()
-		delete(table.items, key)
+		table.removeItem(key)
 	}()
 
 	if table.deleteItem != nil {
@@ -239,14 +854,96 @@ func (table *CacheTable) delete(key string) {
 	if r.aboutToExpire != nil {
 		r.aboutToExpire(key)
 	}
+
+	table.publish(EventDelete, key, r)
 }
 
 // DeleteFromMemoryAndDisk deletes an item from the cache. Unlike DeleteFromMemory this will also delete it from the disk.
+// Invalid keys are ignored as they can never have been added.
 func (table *CacheTable) DeleteFromMemoryAndDisk(key string) {
+	if !validKey(key) {
+		return
+	}
+
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 	table.delete(key)
-	_ = os.Remove(table.getFilePath(key))
+	table.dropPendingKey(key)
+	table.clearInvalidated(key)
+	if table.memoryOnly {
+		return
+	}
+	err := table.fs.Remove(table.getFilePath(key))
+	if err != nil && !os.IsNotExist(err) {
+		table.recordError(err)
+		return
+	}
+	table.indexRemove(key)
+}
+
+// DeleteByPrefix deletes all items whose key starts with prefix from both memory and disk.
+// As keys are spread across the disk this has to walk the entire disk cache.
+// Returns the number of keys deleted.
+func (table *CacheTable) DeleteByPrefix(prefix string) int {
+	keys := make(map[string]bool)
+
+	table.mutex.RLock()
+	for key := range table.items {
+		if strings.HasPrefix(key, prefix) {
+			keys[key] = true
+		}
+	}
+
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		if strings.HasPrefix(key, prefix) {
+			keys[key] = true
+		}
+		return nil
+	})
+	table.mutex.RUnlock()
+
+	// Entries only waiting to be persisted, or invalidated keys not on disk, are in neither memory or disk
+	match := func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}
+	table.dropPending(match)
+	table.clearInvalidatedMatching(match)
+
+	for key := range keys {
+		table.DeleteFromMemoryAndDisk(key)
+	}
+
+	return len(keys)
+}
+
+// GetByPrefix returns all items whose key starts with prefix, either in memory or on disk.
+// Entries only on disk are loaded but not added to memory, nor are any kept alive.
+// As keys are spread across the disk this has to walk & potentially read the entire disk cache.
+func (table *CacheTable) GetByPrefix(prefix string) map[string]*CacheItem {
+	result := make(map[string]*CacheItem)
+
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	for key, item := range table.items {
+		if strings.HasPrefix(key, prefix) {
+			result[key] = item
+		}
+	}
+
+	_ = table.walk(func(key, path string, info os.FileInfo, err error) error {
+		if _, exists := result[key]; !exists && strings.HasPrefix(key, prefix) {
+			if item, _ := table.diskLoader(key); item != nil {
+				result[key] = item
+			}
+		}
+		return nil
+	})
+
+	for key, item := range result {
+		result[key] = table.readItem(item)
+	}
+	return result
 }
 
 // Delete an item from memory only. The entry on disk is kept
@@ -260,18 +957,43 @@ func (table *CacheTable) DeleteFromMemory(key string) {
 // Unlike the Get method Exists neither tries to fetch data via the dataLoader callback nor does it
 // keep the item alive in the cache.
 func (table *CacheTable) Exists(key string) bool {
+	if !validKey(key) {
+		return false
+	}
+
 	table.mutex.RLock()
 	defer table.mutex.RUnlock()
 	_, ok := table.items[key]
 
 	if !ok {
-		_, err := os.Stat(table.getFilePath(key))
-		ok = !os.IsNotExist(err)
+		ok = table.existsOnDisk(key)
 	}
 
 	return ok
 }
 
+// existsOnDisk returns true if the key exists on disk
+func (table *CacheTable) existsOnDisk(key string) bool {
+	if table.memoryOnly {
+		return false
+	}
+	if _, ok := table.pendingEntry(key); ok {
+		return true
+	}
+	if exists, ok := table.indexLookup(key); ok {
+		return exists
+	}
+	_, err := table.fs.Stat(table.getFilePath(key))
+	return !os.IsNotExist(err)
+}
+
+// holds returns true if item is the item in memory for its key, so hasn't been removed or replaced
+func (table *CacheTable) holds(item *CacheItem) bool {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.items[item.key] == item
+}
+
 // ExistsInMemory returns whether an item exists in memory.
 // Unlike the Exists or Get methods ExistsInMemory neither checks the disk nor tries to
 // fetch data via the dataLoader callback nor does it keep the item alive in the cache.
@@ -284,27 +1006,297 @@ func (table *CacheTable) ExistsInMemory(key string) bool {
 
 // Get returns an item from the cache and marks it to be kept alive. You can
 // pass additional arguments to your DataLoader callback function.
+// If the DataLoader returns an error then that is returned wrapped, otherwise ErrKeyNotFound
+// is returned if the key could not be found or ErrInvalidKey if the key is invalid.
 func (table *CacheTable) Get(key string, args ...interface{}) (*CacheItem, error) {
+	return table.GetContext(context.Background(), key, args...)
+}
+
+// GetContext is the same as Get but passes ctx to the DataLoader.
+// If ctx is done before the DataLoader completes then this returns ctx.Err().
+func (table *CacheTable) GetContext(ctx context.Context, key string, args ...interface{}) (*CacheItem, error) {
+	item, _, err := table.GetWithSourceContext(ctx, key, args...)
+	return item, err
+}
+
+// GetWithSource is the same as Get but also returns where the item was found.
+// The Source should be ignored if an error is returned.
+func (table *CacheTable) GetWithSource(key string, args ...interface{}) (*CacheItem, Source, error) {
+	return table.GetWithSourceContext(context.Background(), key, args...)
+}
+
+// GetWithSourceContext is the same as GetContext but also returns where the item was found
+func (table *CacheTable) GetWithSourceContext(ctx context.Context, key string, args ...interface{}) (*CacheItem, Source, error) {
+	if !validKey(key) {
+		return nil, SourceMemory, ErrInvalidKey
+	}
+
 	table.mutex.RLock()
 	r, ok := table.items[key]
 	table.mutex.RUnlock()
 
 	if ok {
+		table.stats.memoryHits.Add(1)
+		table.refreshAhead(r, args...)
 		r.KeepAlive()
-		return r, nil
+		r = table.readItem(r)
+		table.publish(EventGet, key, r)
+		return r, SourceMemory, nil
+	}
+
+	item, source, added, err := table.load(ctx, key, args...)
+	if err != nil {
+		return nil, source, err
+	}
+
+	if !added {
+		table.mutex.Lock()
+		item = table.add(item)
 	}
+	item = table.readItem(item)
+	table.publish(EventGet, key, item)
+	return item, source, nil
+}
 
-	item := table.diskLoader(key)
+// load fetches an item not in memory from disk or via the dataLoader, updating the stats.
+// source is where the item came from.
+// added is true if the item came from the dataLoader, in which case it has already been added to the table,
+// or if it's a stale copy which should not be added.
+func (table *CacheTable) load(ctx context.Context, key string, args ...interface{}) (item *CacheItem, source Source, added bool, err error) {
+	if table.isTombstoned(key) {
+		table.stats.misses.Add(1)
+		return nil, source, false, ErrKeyNotFound
+	}
+
+	// Invalidated keys skip the disk copy so the dataLoader is called
+	invalidated := table.isInvalidated(key)
+	if !invalidated {
+		var expired bool
+		item, expired = table.diskLoader(key)
+		if expired {
+			// Published before the dataLoader so listeners see the expiry before any Add or Get
+			table.expireDiskKey(key)
+		}
+	}
+	stat := &table.stats.diskHits
+	source = SourceDisk
 
 	if item == nil && table.dataLoader != nil {
-		item = table.dataLoader(key, args...)
+		item, err = table.loadSingleFlight(ctx, key, args...)
+		if err != nil {
+			// Serve any copy on disk, including expired ones if serveStaleOnError, rather than the error.
+			// It's not added to memory so the next Get will try the dataLoader again
+			if table.serveStaleOnError || invalidated {
+				stale, expired := table.readDisk(key, table.serveStaleOnError)
+				if expired {
+					table.expireDiskKey(key)
+				}
+				if stale != nil {
+					table.stats.diskHits.Add(1)
+					return stale, SourceDisk, true, nil
+				}
+			}
+
+			table.stats.misses.Add(1)
+			if ctx.Err() != nil {
+				return nil, source, false, err
+			}
+			return nil, source, false, fmt.Errorf("dataloader %q: %w", key, err)
+		}
+		stat = &table.stats.loads
+		source = SourceLoader
+		added = true
+
+		if item == nil || !item.IsValid() {
+			table.addTombstone(key)
+		}
 	}
 
 	if item != nil && item.IsValid() {
+		stat.Add(1)
+		return item, source, added, nil
+	}
+
+	table.stats.misses.Add(1)
+	return nil, source, false, ErrKeyNotFound
+}
+
+// Touch keeps an item alive without reading it.
+// This calls KeepAlive for an item in memory and updates the modification time of the item's
+// file so it is not removed by ExpireDisk.
+// Returns false if the key exists in neither memory or disk, or is not a valid key.
+func (table *CacheTable) Touch(key string) bool {
+	if !validKey(key) {
+		return false
+	}
+
+	table.mutex.RLock()
+	r, ok := table.items[key]
+	table.mutex.RUnlock()
+
+	if ok {
+		r.KeepAlive()
+		_ = table.touchDisk(key, table.now())
+		return true
+	}
+
+	return table.touchDisk(key, table.now()) == nil
+}
+
+// touchDisk sets the modification time of key's file to t
+func (table *CacheTable) touchDisk(key string, t time.Time) error {
+	if table.memoryOnly {
+		return ErrMemoryOnly
+	}
+	return table.fs.Chtimes(table.getFilePath(key), t, t)
+}
+
+// Peek returns an item from memory, or from disk if not in memory, without keeping it alive.
+// Unlike Get this does not update the item's access time or count, never calls the DataLoader and
+// does not add an item read from disk into memory.
+// Returns ErrInvalidKey if the key is invalid or ErrKeyNotFound if it is in neither memory nor disk.
+func (table *CacheTable) Peek(key string) (*CacheItem, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	table.mutex.RLock()
+	r, ok := table.items[key]
+	table.mutex.RUnlock()
+
+	if !ok {
+		var expired bool
+		r, expired = table.diskLoader(key)
+		if expired {
+			table.expireDiskKey(key)
+		}
+	}
+
+	if r == nil {
+		return nil, ErrKeyNotFound
+	}
+	return table.readItem(r), nil
+}
+
+// readItem returns the item to be returned to the caller.
+// If copyOnRead is set this is a copy of the item with a deep copy of the data.
+func (table *CacheTable) readItem(item *CacheItem) *CacheItem {
+	if !table.copyOnRead {
+		return item
+	}
+
+	data, err := table.copyData(item)
+	if err != nil {
+		table.recordError(err)
+		return item
+	}
+
+	item.mutex.RLock()
+	defer item.mutex.RUnlock()
+	return &CacheItem{
+		key:         item.key,
+		data:        data,
+		lifeSpan:    item.lifeSpan,
+		createdOn:   item.createdOn,
+		accessedOn:  item.accessedOn,
+		accessCount: item.accessCount,
+		clock:       item.clock,
+		raw:         item.raw,
+		codec:       item.codec,
+		size:        item.size,
+	}
+}
+
+// copyData returns a deep copy of an item's data made by passing it through its ToBytes & FromBytes
+func (table *CacheTable) copyData(item *CacheItem) (interface{}, error) {
+	v := item.value()
+	if v.raw {
+		return append([]byte(nil), v.data.([]byte)...), nil
+	}
+
+	b, err := table.encodeValue(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %q: %w", item.key, err)
+	}
+
+	var data interface{}
+	if _, fromBytes, _ := table.codecFuncs(v.codec); fromBytes != nil {
+		data, err = safeFromBytes(fromBytes, b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %q: %w", item.key, err)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("failed to decode %q", item.key)
+	}
+	return data, nil
+}
+
+// GetMulti returns the items for multiple keys, marking them to be kept alive.
+// In memory items are retrieved under a single lock, the remainder are loaded from disk or via the
+// DataLoader & then added to memory together.
+// As with Get an EventGet is published for each key found.
+// Keys which cannot be found, or are invalid, are not present in the returned map.
+// If the DataLoader fails for any key then the first error is returned along with the items that were found,
+// otherwise ErrInvalidKey if any key is invalid.
+func (table *CacheTable) GetMulti(keys []string, args ...interface{}) (map[string]*CacheItem, error) {
+	result := make(map[string]*CacheItem, len(keys))
+	published := make(map[string]bool, len(keys))
+	var missing []string
+	var err, invalidErr error
+
+	table.mutex.RLock()
+	for _, key := range keys {
+		if !validKey(key) {
+			invalidErr = ErrInvalidKey
+			continue
+		}
+		if r, ok := table.items[key]; ok {
+			result[key] = r
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	table.mutex.RUnlock()
+
+	for key, r := range result {
+		table.stats.memoryHits.Add(1)
+		r.KeepAlive()
+		result[key] = table.readItem(r)
+	}
+
+	var loaded []*CacheItem
+	for _, key := range missing {
+		item, _, added, loadErr := table.load(context.Background(), key, args...)
+		switch {
+		case loadErr == nil && added:
+			result[key] = table.readItem(item)
+		case loadErr == nil:
+			loaded = append(loaded, item)
+		case loadErr != ErrKeyNotFound && err == nil:
+			err = loadErr
+		}
+	}
+
+	if len(loaded) > 0 {
 		table.mutex.Lock()
-		item = table.add(item)
-		return item, nil
+		_ = table.addAll(loaded)
+
+		for _, item := range loaded {
+			result[item.key] = table.readItem(item)
+		}
 	}
 
-	return nil, ErrKeyNotFound
+	// Publish in the order the keys were requested, once per key found
+	for _, key := range keys {
+		if item, ok := result[key]; ok && !published[key] {
+			published[key] = true
+			table.publish(EventGet, key, item)
+		}
+	}
+
+	if err == nil {
+		err = invalidErr
+	}
+	return result, err
 }
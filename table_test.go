@@ -0,0 +1,689 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLazyDirCreate(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, LazyDirCreate: true})
+
+	if _, err := os.Stat(table.basePath); !os.IsNotExist(err) {
+		t.Fatalf("table directory exists before the first Add: %v", err)
+	}
+	if table.Exists("k") {
+		t.Error("Exists returned true for a missing key")
+	}
+	if _, err := table.Get("k"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v, expected ErrKeyNotFound", err)
+	}
+	if n := table.DiskCount(); n != 0 {
+		t.Errorf("DiskCount %d", n)
+	}
+
+	table.Add("k", "v")
+	if _, err := os.Stat(table.basePath); err != nil {
+		t.Fatalf("table directory not created by Add: %v", err)
+	}
+	table.FlushMemory()
+	if v := mustGet(t, table, "k"); v != "v" {
+		t.Errorf("got %v", v)
+	}
+}
+
+func TestMaxQueuedBytes_blocksAdd(t *testing.T) {
+	fs := &testFS{}
+	table := newTestTables(t, CacheConfig{Filesystem: fs}, CacheTableConfig{
+		StartupOptions:   noStartup,
+		PersistQueueSize: 10,
+		MaxQueuedBytes:   100,
+	})[0]
+
+	// Hold the first write so its bytes stay queued
+	fs.gate = make(chan struct{})
+	value := strings.Repeat("x", 60)
+	table.Add("a", value)
+
+	added := make(chan struct{})
+	go func() {
+		defer close(added)
+		table.Add("b", value)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("Add did not block with MaxQueuedBytes exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(fs.gate)
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add still blocked after the queue drained")
+	}
+
+	table.Sync()
+	for _, key := range []string{"a", "b"} {
+		if !table.existsOnDisk(key) {
+			t.Errorf("%q not written", key)
+		}
+	}
+}
+
+func TestCopyOnRead(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		MemoryOnly:     true,
+		CopyOnRead:     true,
+		ToBytes:        ToJsonBytes,
+		FromBytes: JsonFromBytes(func() interface{} {
+			return &[]string{}
+		}),
+	})
+
+	table.Add("k", &[]string{"a", "b"})
+
+	v := mustGet(t, table, "k").(*[]string)
+	(*v)[0] = "mutated"
+	*v = append(*v, "c")
+
+	if v := mustGet(t, table, "k").(*[]string); len(*v) != 2 || (*v)[0] != "a" {
+		t.Errorf("cached value was mutated: %v", *v)
+	}
+}
+
+func TestPersistError(t *testing.T) {
+	type failure struct {
+		key string
+		err error
+	}
+	failures := make(chan failure, 10)
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		LazyDirCreate:  true,
+		PersistError: func(key string, err error) {
+			failures <- failure{key, err}
+		},
+	})
+
+	// A file where the table's directory should be makes every write fail, even when run as root
+	if err := os.WriteFile(table.basePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	table.Add("k", "v")
+	table.Sync()
+
+	select {
+	case f := <-failures:
+		if f.key != "k" || f.err == nil {
+			t.Errorf("PersistError(%q, %v)", f.key, f.err)
+		}
+	default:
+		t.Fatal("PersistError not called")
+	}
+
+	// The persistence goroutine must still be running
+	if err := os.Remove(table.basePath); err != nil {
+		t.Fatal(err)
+	}
+	table.Add("k2", "v")
+	table.Sync()
+	if !table.existsOnDisk("k2") {
+		t.Error("entry not persisted after a failure")
+	}
+}
+
+func TestStop_drainsQueue(t *testing.T) {
+	cache := NewCache(CacheConfig{CacheDir: t.TempDir()})
+	table, err := cache.AddCache(CacheTableConfig{
+		Name:             "test",
+		StartupOptions:   noStartup,
+		PersistQueueSize: 1000,
+		ToBytes:          stringToBytes,
+		FromBytes:        stringFromBytes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		table.Add(fmt.Sprintf("k%d", i), "v")
+	}
+	cache.Stop()
+
+	for i := 0; i < 500; i++ {
+		if _, err := os.Stat(table.getFilePath(fmt.Sprintf("k%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		table.Add(key, "v")
+	}
+	table.DeleteFromMemory("c")
+	table.DeleteFromMemory("d")
+
+	keys := table.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "a,b,c,d" {
+		t.Errorf("Keys returned %v", keys)
+	}
+
+	keys = table.KeysInMemory()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "a,b" {
+		t.Errorf("KeysInMemory returned %v", keys)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	table.Add("memory", "m")
+	table.Add("disk", "d")
+	table.DeleteFromMemory("disk")
+
+	items, err := table.GetMulti([]string{"memory", "disk", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Errorf("got %d items, expected 2", len(items))
+	}
+	if item := items["memory"]; item == nil || item.Data() != "m" {
+		t.Errorf("memory item %v", item)
+	}
+	if item := items["disk"]; item == nil || item.Data() != "d" {
+		t.Errorf("disk item %v", item)
+	}
+	if _, ok := items["missing"]; ok {
+		t.Error("missing key present in result")
+	}
+
+	// The disk hit is now back in memory
+	if n := table.Count(); n != 2 {
+		t.Errorf("Count %d, expected 2", n)
+	}
+}
+
+func benchmarkKeys(b *testing.B) (*CacheTable, []string) {
+	table := newTestTable(b, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true})
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+		table.Add(keys[i], "v")
+	}
+	return table, keys
+}
+
+func BenchmarkGetMulti(b *testing.B) {
+	table, keys := benchmarkKeys(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = table.GetMulti(keys)
+	}
+}
+
+func BenchmarkGet_loop(b *testing.B) {
+	table, keys := benchmarkKeys(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			_, _ = table.Get(key)
+		}
+	}
+}
+
+func TestGet_loaderError(t *testing.T) {
+	failure := errors.New("backend down")
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			if key == "fail" {
+				return nil, failure
+			}
+			return nil, nil
+		},
+	})
+
+	if _, err := table.Get("fail"); !errors.Is(err, failure) {
+		t.Errorf("Get returned %v, expected %v", err, failure)
+	}
+	if _, err := table.Get("missing"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v, expected %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	var loads int
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		Clock:          clock,
+		DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+			loads++
+			return NewCacheItem(key, 0, "loaded"), nil
+		},
+	})
+
+	table.Add("k", "v")
+	item, err := table.Peek("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, accessed := item.AccessCount(), item.AccessedOn()
+
+	clock.Advance(time.Minute)
+	if _, err := table.Peek("k"); err != nil {
+		t.Fatal(err)
+	}
+	if item.AccessCount() != count || !item.AccessedOn().Equal(accessed) {
+		t.Errorf("Peek changed access count %d to %d, accessed %v to %v",
+			count, item.AccessCount(), accessed, item.AccessedOn())
+	}
+
+	mustGet(t, table, "k")
+	if item.AccessCount() != count+1 || !item.AccessedOn().After(accessed) {
+		t.Error("Get did not update the access count & time")
+	}
+
+	// Peek reads from disk but never calls the DataLoader
+	table.Add("disk", "d")
+	table.DeleteFromMemory("disk")
+	if item, err := table.Peek("disk"); err != nil || item.Data() != "d" {
+		t.Errorf("Peek disk returned %v %v", item, err)
+	}
+	if _, err := table.Peek("missing"); err != ErrKeyNotFound {
+		t.Errorf("Peek missing returned %v", err)
+	}
+	if loads != 0 {
+		t.Errorf("DataLoader called %d times", loads)
+	}
+}
+
+func TestMemoryOnly(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true, SyncPersist: true})
+
+	table.Add("k", "v")
+	table.AddExpiry("short", 50*time.Millisecond, "v")
+	table.Sync()
+
+	var files []string
+	err := filepath.Walk(table.parent.cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("files written %v", files)
+	}
+	if _, err := os.Stat(table.basePath); !os.IsNotExist(err) {
+		t.Errorf("table directory created: %v", err)
+	}
+
+	// The memory expiry timer still runs
+	deadline := time.Now().Add(5 * time.Second)
+	for table.ExistsInMemory("short") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if table.ExistsInMemory("short") {
+		t.Error("item did not expire from memory")
+	}
+
+	table.FlushMemory()
+	if table.Exists("k") {
+		t.Error("Exists true after FlushMemory")
+	}
+	if _, err := table.Get("k"); err != ErrKeyNotFound {
+		t.Errorf("Get returned %v after FlushMemory", err)
+	}
+}
+
+func TestMemoryOnly_deleteLeavesDisk(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true})
+
+	// Files left in the table's directory by something else are never touched
+	for _, key := range []string{"a", "b"} {
+		dir, _ := table.getPath(key)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(table.getFilePath(key), []byte("other"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		table.Add(key, "v")
+	}
+
+	table.DeleteFromMemoryAndDisk("a")
+	if err := table.RenameKey("b", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := os.Stat(table.getFilePath(key)); err != nil {
+			t.Errorf("%q: %v", key, err)
+		}
+	}
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	var deleted []string
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		DeleteItem: func(item *CacheItem) {
+			deleted = append(deleted, item.Key())
+		},
+	})
+
+	for _, key := range []string{"user-1-a", "user-1-b", "user-10-a", "user-2-a", "other"} {
+		table.Add(key, "v")
+	}
+	table.DeleteFromMemory("user-1-b")
+	deleted = nil
+
+	if n := table.DeleteByPrefix("user-1-"); n != 2 {
+		t.Errorf("DeleteByPrefix deleted %d, expected 2", n)
+	}
+	if len(deleted) != 1 || deleted[0] != "user-1-a" {
+		t.Errorf("DeleteItem called for %v", deleted)
+	}
+
+	keys := table.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "other,user-10-a,user-2-a" {
+		t.Errorf("remaining keys %v", keys)
+	}
+}
+
+func TestSync(t *testing.T) {
+	fs := &testFS{}
+	table := newTestTables(t, CacheConfig{Filesystem: fs}, CacheTableConfig{
+		StartupOptions:   noStartup,
+		PersistQueueSize: 10,
+	})[0]
+
+	// Hold the write so Sync has to wait for it
+	fs.gate = make(chan struct{})
+	table.Add("k", "v")
+
+	synced := make(chan struct{})
+	go func() {
+		defer close(synced)
+		table.Sync()
+	}()
+
+	select {
+	case <-synced:
+		t.Fatal("Sync returned before the entry was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(fs.gate)
+	select {
+	case <-synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not return")
+	}
+	if _, err := os.Stat(table.getFilePath("k")); err != nil {
+		t.Errorf("file does not exist after Sync: %v", err)
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	failure := errors.New("backend down")
+	cfg := func(name string, serveStale bool) CacheTableConfig {
+		return CacheTableConfig{
+			Name:              name,
+			StartupOptions:    noStartup,
+			SyncPersist:       true,
+			DiskExpiryTime:    time.Hour,
+			ServeStaleOnError: serveStale,
+			DataLoader: func(key string, args ...interface{}) (*CacheItem, error) {
+				return nil, failure
+			},
+		}
+	}
+	tables := newTestTables(t, CacheConfig{}, cfg("stale", true), cfg("strict", false))
+
+	for _, table := range tables {
+		table.Add("k", "stale value")
+		table.FlushMemory()
+		setModTime(t, table, "k", time.Now().Add(-2*time.Hour))
+	}
+
+	if v := mustGet(t, tables[0], "k"); v != "stale value" {
+		t.Errorf("got %v, expected the stale value", v)
+	}
+	if _, err := tables[1].Get("k"); !errors.Is(err, failure) {
+		t.Errorf("Get returned %v, expected %v", err, failure)
+	}
+}
+
+func TestAddErr(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true})
+
+	tests := []struct {
+		key      string
+		lifeSpan time.Duration
+		data     interface{}
+		err      error
+	}{
+		{"k", time.Minute, "v", nil},
+		{"", time.Minute, "v", ErrInvalidKey},
+		{"a/b", time.Minute, "v", ErrInvalidKey},
+		{"k", time.Minute, nil, ErrNilData},
+		{"k", -time.Minute, "v", ErrInvalidLifespan},
+	}
+	for _, test := range tests {
+		item, err := table.AddExpiryErr(test.key, test.lifeSpan, test.data)
+		if err != test.err {
+			t.Errorf("AddExpiryErr(%q, %v, %v) returned %v, expected %v", test.key, test.lifeSpan, test.data, err, test.err)
+		}
+		if (item == nil) != (test.err != nil) {
+			t.Errorf("AddExpiryErr(%q, %v, %v) returned item %v", test.key, test.lifeSpan, test.data, item)
+		}
+		if added := table.AddExpiry(test.key, test.lifeSpan, test.data) != nil; added != (test.err == nil) {
+			t.Errorf("AddExpiry(%q, %v, %v) added %v", test.key, test.lifeSpan, test.data, added)
+		}
+	}
+
+	if _, err := table.AddErr("k", nil); err != ErrNilData {
+		t.Errorf("AddErr returned %v, expected %v", err, ErrNilData)
+	}
+}
+
+func TestForeachE(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true})
+	for i := 0; i < 10; i++ {
+		table.Add(fmt.Sprintf("k%d", i), "v")
+	}
+
+	// Map order is random so stop at the first match of several
+	visited := 0
+	err := table.ForeachE(func(key string, item *CacheItem) error {
+		visited++
+		if key != "k0" {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("ForeachE returned %v for ErrStopIteration", err)
+	}
+	if visited > 2 {
+		t.Errorf("visited %d items, iteration did not stop", visited)
+	}
+
+	failure := errors.New("failure")
+	visited = 0
+	err = table.ForeachE(func(key string, item *CacheItem) error {
+		visited++
+		return failure
+	})
+	if err != failure {
+		t.Errorf("ForeachE returned %v, expected %v", err, failure)
+	}
+	if visited != 1 {
+		t.Errorf("visited %d items after an error, expected 1", visited)
+	}
+}
+
+func TestForeachSorted(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, MemoryOnly: true})
+	for _, key := range []string{"b", "d", "a", "c"} {
+		table.Add(key, "v")
+	}
+
+	var keys []string
+	table.ForeachSorted(nil, func(key string, item *CacheItem) {
+		keys = append(keys, key)
+	})
+	if strings.Join(keys, ",") != "a,b,c,d" {
+		t.Errorf("default order %v", keys)
+	}
+
+	keys = nil
+	table.ForeachSorted(func(a, b string) bool {
+		return a > b
+	}, func(key string, item *CacheItem) {
+		keys = append(keys, key)
+	})
+	if strings.Join(keys, ",") != "d,c,b,a" {
+		t.Errorf("reverse order %v", keys)
+	}
+}
+
+func TestGetByPrefix(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	for _, key := range []string{"user-1-a", "user-1-b", "user-10-a", "user-2-a", "other"} {
+		table.Add(key, "v:"+key)
+	}
+	table.DeleteFromMemory("user-1-b")
+
+	items := table.GetByPrefix("user-1-")
+	if len(items) != 2 {
+		t.Errorf("GetByPrefix returned %d items, expected 2", len(items))
+	}
+	for _, key := range []string{"user-1-a", "user-1-b"} {
+		item, ok := items[key]
+		if !ok {
+			t.Errorf("%s missing", key)
+			continue
+		}
+		if item.Data() != "v:"+key {
+			t.Errorf("%s got %v", key, item.Data())
+		}
+	}
+	if table.ExistsInMemory("user-1-b") {
+		t.Error("GetByPrefix added a disk entry to memory")
+	}
+
+	if items := table.GetByPrefix("none"); len(items) != 0 {
+		t.Errorf("GetByPrefix returned %d items for an unused prefix", len(items))
+	}
+}
+
+func TestSyncPersist(t *testing.T) {
+	fs := &testFS{}
+	tables := newTestTables(t, CacheConfig{Filesystem: fs},
+		CacheTableConfig{StartupOptions: noStartup, SyncPersist: true},
+	)
+	table := tables[0]
+
+	if _, err := table.AddErr("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(table.getFilePath("k")); err != nil {
+		t.Errorf("file not written when Add returned: %v", err)
+	}
+
+	failure := errors.New("disk full")
+	fs.writeErr.Store(failure)
+	if _, err := table.AddErr("fail", "v"); !errors.Is(err, failure) {
+		t.Errorf("AddErr returned %v, expected %v", err, failure)
+	}
+	if table.existsOnDisk("fail") {
+		t.Error("failed write left a file on disk")
+	}
+}
+
+func TestInvalidKeys_neverTouchDisk(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	// A file outside of the table which the key resolves to once its directory exists
+	const key = "../../../../victim"
+	victim := filepath.Join(filepath.Dir(table.parent.cacheDir), "victim")
+	if err := os.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := table.getPath(key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	escaped := filepath.Join(filepath.Dir(table.parent.cacheDir), "escaped")
+
+	if table.NotFoundAdd("../../../../escaped", "v") {
+		t.Error("NotFoundAdd added an invalid key")
+	}
+	if table.NotFoundAdd("k", nil) {
+		t.Error("NotFoundAdd added nil data")
+	}
+	table.DeleteFromMemoryAndDisk(key)
+	table.Invalidate(key)
+	if table.Exists(key) {
+		t.Error("Exists returned true")
+	}
+	if n := table.Warm(key); n != 0 {
+		t.Errorf("Warm loaded %d", n)
+	}
+	if _, err := table.Get(key); err != ErrInvalidKey {
+		t.Errorf("Get returned %v", err)
+	}
+	if _, err := table.Peek(key); err != ErrInvalidKey {
+		t.Errorf("Peek returned %v", err)
+	}
+	if _, err := table.GetStream(key); err != ErrInvalidKey {
+		t.Errorf("GetStream returned %v", err)
+	}
+	if _, err := table.GetMulti([]string{key}); err != ErrInvalidKey {
+		t.Errorf("GetMulti returned %v", err)
+	}
+	if err := table.RenameKey(key, "k"); err != ErrInvalidKey {
+		t.Errorf("RenameKey returned %v", err)
+	}
+	if err := table.CopyKey(key, "k"); err != ErrInvalidKey {
+		t.Errorf("CopyKey returned %v", err)
+	}
+
+	if b, err := os.ReadFile(victim); err != nil || string(b) != "original" {
+		t.Errorf("file outside the table is now %q %v", b, err)
+	}
+	if _, err := os.Stat(escaped); !os.IsNotExist(err) {
+		t.Errorf("file written outside the table: %v", err)
+	}
+	if table.Exists("k") {
+		t.Error("k added")
+	}
+}
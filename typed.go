@@ -0,0 +1,55 @@
+package filecache
+
+import (
+	"errors"
+)
+
+var (
+	// ErrTypeMismatch is returned by TypedTable when a value cannot be converted to the table's type
+	ErrTypeMismatch = errors.New("typemismatch")
+)
+
+// TypedTable wraps a CacheTable so values are of type T rather than interface{}.
+//
+// Values read from the table which are not of type T, e.g. they were loaded from disk by a
+// generic FromBytes, are converted to T via JSON.
+type TypedTable[T any] struct {
+	*CacheTable
+}
+
+// NewTypedTable returns a TypedTable wrapping a CacheTable
+func NewTypedTable[T any](table *CacheTable) *TypedTable[T] {
+	return &TypedTable[T]{CacheTable: table}
+}
+
+// Add adds a value to the table using the default expiry time for the table.
+// This returns the CacheItem just added or nil if there was an error.
+func (t *TypedTable[T]) Add(key string, v T) *CacheItem {
+	return t.CacheTable.Add(key, v)
+}
+
+// Get returns a value from the table.
+// On a miss or if the value cannot be converted to T this returns the zero value of T and an error.
+func (t *TypedTable[T]) Get(key string) (T, error) {
+	var zero T
+
+	item, err := t.CacheTable.Get(key)
+	if err != nil {
+		return zero, err
+	}
+
+	v, ok := convertValue[T](item.Data())
+	if !ok {
+		return zero, ErrTypeMismatch
+	}
+	return v, nil
+}
+
+// Foreach calls f for each value in memory which can be converted to T
+func (t *TypedTable[T]) Foreach(f func(string, T)) {
+	t.CacheTable.Foreach(func(key string, item *CacheItem) {
+		if v, ok := convertValue[T](item.Data()); ok {
+			f(key, v)
+		}
+	})
+}
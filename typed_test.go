@@ -0,0 +1,58 @@
+package filecache
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type typedRecord struct {
+	Name  string
+	Count int
+}
+
+func TestTypedTable(t *testing.T) {
+	table := NewTypedTable[typedRecord](newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		ToBytes:        ToJsonBytes,
+		FromBytes: func(b []byte) interface{} {
+			var v interface{}
+			if json.Unmarshal(b, &v) != nil {
+				return nil
+			}
+			return v
+		},
+	}))
+
+	v := typedRecord{Name: "test", Count: 42}
+	table.Add("k", v)
+
+	got, err := table.Get("k")
+	if err != nil || got != v {
+		t.Errorf("Get from memory returned %+v %v", got, err)
+	}
+
+	// From disk the value is a map which is converted to typedRecord
+	table.FlushMemory()
+	got, err = table.Get("k")
+	if err != nil || got != v {
+		t.Errorf("Get from disk returned %+v %v", got, err)
+	}
+
+	var keys []string
+	table.Foreach(func(key string, v typedRecord) {
+		keys = append(keys, key)
+	})
+	if len(keys) != 1 || keys[0] != "k" {
+		t.Errorf("Foreach visited %v", keys)
+	}
+
+	if _, err := table.Get("missing"); err != ErrKeyNotFound {
+		t.Errorf("Get missing returned %v", err)
+	}
+
+	table.CacheTable.Add("string", "not a record")
+	if got, err := table.Get("string"); err != ErrTypeMismatch || got != (typedRecord{}) {
+		t.Errorf("Get of a mismatched type returned %+v %v", got, err)
+	}
+}
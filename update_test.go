@@ -0,0 +1,141 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdate_concurrentWithGet(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup})
+	table.Add("k", "0")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 200; i++ {
+			if _, err := table.Update("k", strconv.Itoa(i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if _, err := table.Get("k"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	table.Sync()
+	table.FlushMemory()
+	if v := mustGet(t, table, "k"); v != "200" {
+		t.Errorf("got %v, expected the last update", v)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true, Clock: clock})
+
+	item := table.AddExpiry("k", time.Hour, "old")
+	mustGet(t, table, "k")
+	createdOn, accessCount := item.CreatedOn(), item.AccessCount()
+
+	clock.Advance(time.Minute)
+	updated, err := table.Update("k", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Data() != "new" {
+		t.Errorf("got %v", updated.Data())
+	}
+	if !updated.CreatedOn().Equal(createdOn) {
+		t.Errorf("createdOn %v, expected %v", updated.CreatedOn(), createdOn)
+	}
+	if updated.AccessCount() != accessCount {
+		t.Errorf("accessCount %d, expected %d", updated.AccessCount(), accessCount)
+	}
+	if updated.LifeSpan() != time.Hour {
+		t.Errorf("lifeSpan %v, expected 1h", updated.LifeSpan())
+	}
+
+	table.FlushMemory()
+	if v := mustGet(t, table, "k"); v != "new" {
+		t.Errorf("persisted value %v", v)
+	}
+
+	if _, err := table.Update("missing", "v"); err != ErrKeyNotFound {
+		t.Errorf("Update of a missing key returned %v", err)
+	}
+}
+
+func TestUpdate_diskOnly(t *testing.T) {
+	var added []string
+	table := newTestTable(t, CacheTableConfig{
+		StartupOptions: noStartup,
+		SyncPersist:    true,
+		ExpiryTime:     time.Hour,
+		MaxMemoryItems: 1,
+		AddItem: func(item *CacheItem) {
+			added = append(added, item.Key())
+		},
+	})
+
+	table.Add("k", "old")
+	table.FlushMemory()
+	table.Add("other", "v")
+	added = nil
+
+	item, err := table.Update("k", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Data() != "new" {
+		t.Errorf("got %v", item.Data())
+	}
+
+	// Added to memory as Add would, so the callback is called, expiry scheduled & MaxMemoryItems honoured
+	if len(added) != 1 || added[0] != "k" {
+		t.Errorf("AddItem called for %v, expected [k]", added)
+	}
+	table.mutex.RLock()
+	cleanupAt := table.cleanupAt
+	table.mutex.RUnlock()
+	if cleanupAt.IsZero() {
+		t.Error("memory expiry not scheduled")
+	}
+	if !table.ExistsInMemory("k") || table.Count() != 1 {
+		t.Errorf("memory holds %v, expected [k]", table.KeysInMemory())
+	}
+
+	table.FlushMemory()
+	if v := mustGet(t, table, "k"); v != "new" {
+		t.Errorf("persisted value %v", v)
+	}
+}
+
+func TestUpdate_invalidKey(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, SyncPersist: true})
+
+	// A file outside of the table which a traversal key would resolve to
+	victim := filepath.Join(table.parent.cacheDir, "victim")
+	if err := os.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := table.Update("../../../victim", "pwned"); err != ErrInvalidKey {
+		t.Errorf("Update returned %v, expected %v", err, ErrInvalidKey)
+	}
+	if b, err := os.ReadFile(victim); err != nil || string(b) != "original" {
+		t.Errorf("file outside the table is now %q %v", b, err)
+	}
+}
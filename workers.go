@@ -0,0 +1,67 @@
+package filecache
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// drainQueue persists the entries from queue until it is closed.
+// With persistWorkers greater than 1 the entries are written by that many goroutines, with all entries
+// for the same key going to the same goroutine so they are still written in the order they were queued.
+func (table *CacheTable) drainQueue(queue chan persistEntry) {
+	if table.persistWorkers <= 1 {
+		for e := range queue {
+			table.persistQueued(e)
+		}
+		return
+	}
+
+	workers := make([]chan persistEntry, table.persistWorkers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		w := make(chan persistEntry, table.persistQueueSize)
+		workers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range w {
+				table.persistQueued(e)
+			}
+		}()
+	}
+
+	for e := range queue {
+		if e.synced != nil {
+			// Wait for every worker to write everything queued before the Sync
+			synced := make([]chan struct{}, len(workers))
+			for i, w := range workers {
+				synced[i] = make(chan struct{})
+				w <- persistEntry{synced: synced[i]}
+			}
+			for _, s := range synced {
+				<-s
+			}
+			close(e.synced)
+			continue
+		}
+
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(e.key))
+		workers[h.Sum32()%uint32(len(workers))] <- e
+	}
+
+	for _, w := range workers {
+		close(w)
+	}
+	wg.Wait()
+}
+
+// persistQueued writes an entry taken from the persistence queue
+func (table *CacheTable) persistQueued(e persistEntry) {
+	if e.synced != nil {
+		close(e.synced)
+		return
+	}
+	_ = table.persist(e)
+	table.dequeued(e)
+}
@@ -0,0 +1,47 @@
+package filecache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPersistWorkers_sameKeyOrdered(t *testing.T) {
+	table := newTestTable(t, CacheTableConfig{StartupOptions: noStartup, PersistWorkers: 4})
+
+	const keys, writes = 10, 50
+	for i := 0; i < writes; i++ {
+		for k := 0; k < keys; k++ {
+			table.Add(fmt.Sprintf("k%d", k), fmt.Sprintf("v%d", i))
+		}
+	}
+	table.Sync()
+
+	expected := fmt.Sprintf("v%d", writes-1)
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprintf("k%d", k)
+		item, _ := table.readDisk(key, false)
+		if item == nil {
+			t.Errorf("%q not on disk", key)
+		} else if item.Data() != expected {
+			t.Errorf("%q on disk is %v, expected %s", key, item.Data(), expected)
+		}
+	}
+}
+
+func BenchmarkPersistWorkers(b *testing.B) {
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			table := newTestTable(b, CacheTableConfig{
+				StartupOptions:   noStartup,
+				PersistWorkers:   workers,
+				PersistQueueSize: 1000,
+			})
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				table.Add(fmt.Sprintf("k%d", i), "v")
+			}
+			table.Sync()
+		})
+	}
+}